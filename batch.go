@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// gameRecordExtensions are the file extensions that are picked up when
+// directories are searched for game records
+var gameRecordExtensions = map[string]bool{
+	".sgf": true,
+	".gib": true,
+	".ngf": true,
+}
+
+// batchInput is a game record to process. Found is true if the file was
+// found by searching a directory or expanding a pattern, and false if it was
+// named on the command line.
+type batchInput struct {
+	path  string
+	found bool
+}
+
+// expandInputs expands the command-line arguments to a list of game records.
+// Directories are searched recursively and glob patterns are expanded, while
+// files and URLs are kept as they are. Reviewed SGF files written by earlier
+// runs are left out of directory searches and pattern matches. With -f, directories are searched
+// for JSON files instead.
+func expandInputs(args []string, opts Options, analyzeJSON bool) []batchInput {
+	inputs := make([]batchInput, 0, len(args))
+	seen := make(map[string]bool)
+	add := func(input string, found bool) {
+		if !seen[input] {
+			seen[input] = true
+			inputs = append(inputs, batchInput{input, found})
+		}
+	}
+
+	for _, arg := range args {
+		if isURL(arg) {
+			add(arg, false)
+			continue
+		}
+
+		matches := []string{arg}
+		pattern := strings.ContainsAny(arg, "*?[")
+		if pattern {
+			var err error
+			matches, err = filepath.Glob(arg)
+			if err != nil {
+				log.Printf("Invalid pattern %q: %v", arg, err)
+				continue
+			}
+			if len(matches) == 0 {
+				log.Printf("No files match %q", arg)
+				continue
+			}
+		}
+
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil || !info.IsDir() {
+				// Errors are reported when the file is processed
+				if !pattern || analyzeJSON || isGameRecord(match, opts) {
+					add(match, pattern)
+				}
+				continue
+			}
+			err = filepath.WalkDir(match, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if d.IsDir() {
+					return nil
+				}
+				if analyzeJSON && strings.EqualFold(filepath.Ext(path), ".json") || !analyzeJSON && isGameRecord(path, opts) {
+					add(path, true)
+				}
+				return nil
+			})
+			if err != nil {
+				log.Printf("Error searching %s: %v", match, err)
+			}
+		}
+	}
+
+	return inputs
+}
+
+// isGameRecord returns true if the file looks like a game record that should
+// be analyzed, and not like a file that was written by this program
+func isGameRecord(path string, opts Options) bool {
+	ext := filepath.Ext(path)
+	if !gameRecordExtensions[strings.ToLower(ext)] {
+		return false
+	}
+	suffix := opts.SGF.FileSuffix
+	return suffix == "" || !strings.HasSuffix(strings.TrimSuffix(path, ext), suffix)
+}
+
+// outputFiles returns the files that are written for a game, given the base
+// name of the game
+func outputFiles(base string, saveJSON bool, opts Options) []string {
+	outputs := []string{reviewedSGFPath(base, opts), htmlReportPath(base, opts)}
+	if saveJSON {
+		outputs = append(outputs, base+".json")
+	}
+	return outputs
+}
+
+// upToDate returns true if all output files of a game record exist and are
+// newer than the game record itself. For collections, the outputs of the
+// first game are checked.
+func upToDate(filePath string, saveJSON bool, opts Options) bool {
+	input, err := os.Stat(filePath)
+	if err != nil {
+		return false
+	}
+	base := strings.TrimSuffix(filePath, filepath.Ext(filePath))
+	for _, candidate := range []string{base, base + "-1"} {
+		outputs := outputFiles(candidate, saveJSON, opts)
+		if len(outputs) == 0 {
+			return false
+		}
+		newer := true
+		for _, output := range outputs {
+			info, err := os.Stat(output)
+			if err != nil || !info.ModTime().After(input.ModTime()) {
+				newer = false
+				break
+			}
+		}
+		if newer {
+			return true
+		}
+	}
+	return false
+}
+
+// runBatch analyzes the game records with a pool of workers, which share
+// one or more long-lived KataGo engines. No engines are started with -f. The
+// summaries of all games are returned in the order of the inputs.
+func runBatch(inputs []batchInput, opts Options, workers int, revisit int, saveJSON bool, analyzeJSON bool) []GameSummary {
+	if workers < 1 {
+		workers = 1
+	}
+	numEngines := opts.KataGo.Engines
+	if numEngines < 1 {
+		numEngines = 1
+	}
+	if numEngines > workers {
+		numEngines = workers
+	}
+
+	engines := make([]*KataGoClient, numEngines)
+	if !analyzeJSON {
+		for i := range engines {
+			engine, err := startKataGo(opts)
+			if err != nil {
+				log.Fatalf("Failed to start KataGo: %v", err)
+			}
+			engines[i] = engine
+		}
+	}
+
+	results := make([][]GameSummary, len(inputs))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(engine *KataGoClient) {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = processInput(inputs[i], engine, opts, revisit, saveJSON, analyzeJSON)
+			}
+		}(engines[w%numEngines])
+	}
+
+	for i := range inputs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, engine := range engines {
+		if engine != nil {
+			if err := engine.Close(); err != nil {
+				log.Printf("KataGo did not exit cleanly: %v", err)
+			}
+		}
+	}
+
+	summaries := make([]GameSummary, 0, len(inputs))
+	for _, result := range results {
+		summaries = append(summaries, result...)
+	}
+	return summaries
+}
+
+// processInput downloads the game record if it is given as a URL, skips it
+// if it was found in a directory or by a pattern and its outputs are up to
+// date, and otherwise analyzes every game in it. Files named on the command
+// line and JSON files given with -f are never skipped, so that they can be
+// analyzed again with other options.
+func processInput(input batchInput, engine *KataGoClient, opts Options, revisit int, saveJSON bool, analyzeJSON bool) []GameSummary {
+	filePath := input.path
+	// Game records given as URLs are downloaded to the current directory
+	if isURL(filePath) {
+		localPath, err := downloadGame(nil, filePath, ".")
+		if err != nil {
+			log.Printf("Error downloading game record: %v", err)
+			return []GameSummary{{Name: filePath, Status: "failed: " + err.Error()}}
+		}
+		filePath = localPath
+	} else if input.found && !analyzeJSON && upToDate(filePath, saveJSON, opts) {
+		fmt.Printf("skipped: %s is up to date\n", filePath)
+		return []GameSummary{{Name: filePath, Status: "skipped: up to date"}}
+	}
+
+	summaries, err := processFile(filePath, engine, opts, revisit, saveJSON, analyzeJSON)
+	if err != nil {
+		log.Printf("Error loading game record: %v", err)
+		return []GameSummary{{Name: filePath, Status: "failed: " + err.Error()}}
+	}
+	return summaries
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+// ErrClientClosed is returned when a query is submitted after Close
+var ErrClientClosed = errors.New("KataGo client is closed")
+
+// illegalMovePattern finds the index of the move in KataGo's error for a
+// query with an illegal move, such as "Illegal move 83: D4"
+var illegalMovePattern = regexp.MustCompile(`^Illegal move (\d+)`)
+
+// KataGoError is an error that KataGo reported for a query, which ends the
+// query
+type KataGoError struct {
+	ID      string
+	Field   string
+	Message string
+}
+
+func (e *KataGoError) Error() string {
+	if e.Field == "" {
+		return "KataGo error: " + e.Message
+	}
+	return fmt.Sprintf("KataGo error: %s (field %q)", e.Message, e.Field)
+}
+
+// IllegalMove returns the index in the moves of the query of the move that
+// KataGo found illegal, if that is the error
+func (e *KataGoError) IllegalMove() (int, bool) {
+	if e.Field != "moves" {
+		return 0, false
+	}
+	m := illegalMovePattern.FindStringSubmatch(e.Message)
+	if m == nil {
+		return 0, false
+	}
+	index, err := strconv.Atoi(m[1])
+	return index, err == nil
+}
+
+// KataGoWarning is a warning that KataGo reported for a query, such as an
+// unknown field. The query is still analyzed.
+type KataGoWarning struct {
+	ID      string
+	Field   string
+	Message string
+}
+
+func (w KataGoWarning) String() string {
+	if w.Field == "" {
+		return w.Message
+	}
+	return fmt.Sprintf("%s (field %q)", w.Message, w.Field)
+}
+
+// TurnError is a problem that leaves a single turn of a query without
+// results, while the other turns are still analyzed
+type TurnError struct {
+	ID     string
+	Turn   int
+	Reason string
+}
+
+func (e *TurnError) Error() string {
+	return fmt.Sprintf("query %s, turn %d: %s", e.ID, e.Turn, e.Reason)
+}
+
+// Err returns the problem with the turn of a response, or nil if it has
+// results
+func (r AnalysisResponse) Err() *TurnError {
+	if r.NoResults {
+		return &TurnError{ID: r.ID, Turn: r.TurnNumber, Reason: "no results"}
+	}
+	return nil
+}
+
+// kataGoMessage holds the fields that tell what kind of line KataGo sent:
+// a response, an error or warning for a query, or a reply to an action
+type kataGoMessage struct {
+	ID      string `json:"id"`
+	Action  string `json:"action"`
+	Error   string `json:"error"`
+	Warning string `json:"warning"`
+	Field   string `json:"field"`
+}
+
+// KataGoClient runs the KataGo analysis engine and sends queries to it. Any
+// number of goroutines can submit queries at the same time. KataGo works on
+// them in parallel, and a reader goroutine routes the responses to their
+// query by ID as they arrive.
+type KataGoClient struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	writeMu sync.Mutex // serializes writes to stdin
+
+	mu      sync.Mutex
+	pending map[string]*Query
+	closed  bool
+	err     error // set when KataGo has stopped responding
+
+	readers sync.WaitGroup
+}
+
+// Query is a query that was submitted to KataGo. Responses receives one
+// response for every analyzed turn, in the order they arrive, and is closed
+// when all responses have arrived or the query has ended early.
+type Query struct {
+	ID        string
+	Responses <-chan AnalysisResponse
+
+	responses chan AnalysisResponse
+	remaining int
+	done      chan struct{}
+	err       error
+	warnings  []KataGoWarning
+}
+
+// Err returns the reason the query ended early, or nil if all responses
+// arrived. It must only be called after Responses is closed.
+func (q *Query) Err() error {
+	return q.err
+}
+
+// Warnings returns the warnings that KataGo reported for the query. It must
+// only be called after Responses is closed.
+func (q *Query) Warnings() []KataGoWarning {
+	return q.warnings
+}
+
+// NewKataGoClient starts KataGo with the given arguments, which should start
+// the analysis engine
+func NewKataGoClient(path string, args []string) (*KataGoClient, error) {
+	cmd := exec.Command(path, args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting KataGo: %v", err)
+	}
+
+	c := &KataGoClient{
+		cmd:     cmd,
+		stdin:   stdin,
+		pending: make(map[string]*Query),
+	}
+
+	// Read stderr to debug any issues
+	c.readers.Add(2)
+	go func() {
+		defer c.readers.Done()
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			fmt.Printf("KataGo stderr: %s\n", scanner.Text())
+		}
+	}()
+	go c.readResponses(stdout)
+
+	return c, nil
+}
+
+// expectedResponses returns the number of responses that KataGo sends for a
+// request. Without analyzeTurns, only the last turn is analyzed.
+func expectedResponses(request AnalysisRequest) int {
+	if len(request.AnalyzeTurns) == 0 {
+		return 1
+	}
+	return len(request.AnalyzeTurns)
+}
+
+// Submit sends a query to KataGo without waiting for the responses. The ID of
+// the request must not be used by another query that is still running. If
+// the context is canceled before all responses have arrived, KataGo is told
+// to stop the query and the query ends with the error of the context.
+func (c *KataGoClient) Submit(ctx context.Context, request AnalysisRequest) (*Query, error) {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	n := expectedResponses(request)
+	responses := make(chan AnalysisResponse, n)
+	q := &Query{
+		ID:        request.ID,
+		Responses: responses,
+		responses: responses,
+		remaining: n,
+		done:      make(chan struct{}),
+	}
+
+	c.mu.Lock()
+	switch {
+	case c.closed:
+		err = ErrClientClosed
+	case c.err != nil:
+		err = c.err
+	case c.pending[q.ID] != nil:
+		err = fmt.Errorf("query %s is already running", q.ID)
+	default:
+		c.pending[q.ID] = q
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.write(data); err != nil {
+		c.finish(q, err)
+		return nil, err
+	}
+
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				if c.finish(q, ctx.Err()) {
+					c.terminate(q.ID)
+				}
+			case <-q.done:
+			}
+		}()
+	}
+	return q, nil
+}
+
+// Close closes the input of KataGo, which makes it finish the queries it has
+// received and exit, and waits for it to do so
+func (c *KataGoClient) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	c.writeMu.Lock()
+	c.stdin.Close()
+	c.writeMu.Unlock()
+
+	c.readers.Wait()
+	return c.cmd.Wait()
+}
+
+// write sends a line of JSON to KataGo
+func (c *KataGoClient) write(data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.stdin.Write(append(data, '\n'))
+	return err
+}
+
+// terminate tells KataGo to stop working on a query. The responses that are
+// still sent for it are ignored.
+func (c *KataGoClient) terminate(id string) {
+	action := struct {
+		ID          string `json:"id"`
+		Action      string `json:"action"`
+		TerminateID string `json:"terminateId"`
+	}{"terminate-" + id, "terminate", id}
+	data, err := json.Marshal(action)
+	if err == nil {
+		err = c.write(data)
+	}
+	if err != nil {
+		log.Printf("Error terminating KataGo query %s: %v", id, err)
+	}
+}
+
+// finish ends a query that is still running and closes its responses. It
+// returns false if the query had already ended.
+func (c *KataGoClient) finish(q *Query, err error) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.finishLocked(q, err)
+}
+
+// finishLocked is finish for callers that hold the lock
+func (c *KataGoClient) finishLocked(q *Query, err error) bool {
+	if c.pending[q.ID] != q {
+		return false
+	}
+	delete(c.pending, q.ID)
+	q.err = err
+	close(q.responses)
+	close(q.done)
+	return true
+}
+
+// readResponses reads the output of KataGo and routes every response to its
+// query. When KataGo exits, all running queries end with an error.
+func (c *KataGoClient) readResponses(stdout io.Reader) {
+	defer c.readers.Done()
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		c.route(scanner.Bytes())
+	}
+
+	err := scanner.Err()
+	if err == nil {
+		err = errors.New("KataGo exited")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+	for _, q := range c.pending {
+		c.finishLocked(q, err)
+	}
+}
+
+// route handles a line of KataGo output
+func (c *KataGoClient) route(line []byte) {
+	var message kataGoMessage
+	if err := json.Unmarshal(line, &message); err != nil {
+		log.Printf("Ignoring KataGo output: %.80s", line)
+		return
+	}
+	if message.Action != "" {
+		// Replies to actions such as terminate
+		return
+	}
+
+	c.mu.Lock()
+	q := c.pending[message.ID]
+	c.mu.Unlock()
+	if q == nil {
+		// Queries that have been terminated, or were not sent by this client
+		if message.Error != "" {
+			log.Printf("KataGo error: %s", message.Error)
+		}
+		return
+	}
+
+	switch {
+	case message.Error != "":
+		c.finish(q, &KataGoError{ID: q.ID, Field: message.Field, Message: message.Error})
+	case message.Warning != "":
+		c.mu.Lock()
+		q.warnings = append(q.warnings, KataGoWarning{ID: q.ID, Field: message.Field, Message: message.Warning})
+		c.mu.Unlock()
+	default:
+		var response AnalysisResponse
+		if err := json.Unmarshal(line, &response); err != nil {
+			log.Printf("Ignoring KataGo output: %.80s", line)
+			return
+		}
+		if response.IsDuringSearch {
+			// Only the final response for each turn is passed on
+			return
+		}
+		c.deliver(q, response)
+	}
+}
+
+// deliver passes a response to its query, and ends the query when it was
+// the last one
+func (c *KataGoClient) deliver(q *Query, response AnalysisResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending[q.ID] != q {
+		return
+	}
+	// The channel has room for every response, so this never blocks
+	q.responses <- response
+	q.remaining--
+	if q.remaining == 0 {
+		c.finishLocked(q, nil)
+	}
+}
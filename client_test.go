@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv("TOP3_FAKE_KATAGO") != "" {
+		fakeKataGo()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// fakeKataGo is a small stand-in for the KataGo analysis engine, which runs
+// when a test starts the test binary with TOP3_FAKE_KATAGO set. It answers
+// the turns of a query in reverse order, and how it answers depends on the
+// prefix of the query ID:
+//
+//	error  reports an illegal move
+//	warn   reports a warning, and then answers
+//	hold   answers after the next query, or when its input is closed
+//	hang   never answers
+//	exit   exits without answering
+//
+// Every line that it reads is written to the file in TOP3_FAKE_KATAGO_LOG.
+func fakeKataGo() {
+	logFile, err := os.Create(os.Getenv("TOP3_FAKE_KATAGO_LOG"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer logFile.Close()
+
+	type fakeQuery struct {
+		ID           string `json:"id"`
+		Action       string `json:"action"`
+		TerminateID  string `json:"terminateId"`
+		AnalyzeTurns []int  `json:"analyzeTurns"`
+	}
+	out := json.NewEncoder(os.Stdout)
+	answer := func(q fakeQuery) {
+		for i := len(q.AnalyzeTurns) - 1; i >= 0; i-- {
+			turn := q.AnalyzeTurns[i]
+			out.Encode(AnalysisResponse{ID: q.ID, TurnNumber: turn, IsDuringSearch: true})
+			out.Encode(AnalysisResponse{ID: q.ID, TurnNumber: turn, RootInfo: RootInfo{Visits: 100}})
+		}
+	}
+
+	var held []fakeQuery
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		fmt.Fprintln(logFile, scanner.Text())
+		var q fakeQuery
+		if err := json.Unmarshal(scanner.Bytes(), &q); err != nil {
+			out.Encode(map[string]string{"error": "Could not parse input line as json request"})
+			continue
+		}
+		switch {
+		case q.Action == "terminate":
+			out.Encode(map[string]string{"id": q.ID, "action": "terminate", "terminateId": q.TerminateID})
+			continue
+		case strings.HasPrefix(q.ID, "error"):
+			out.Encode(map[string]string{"id": q.ID, "error": "Illegal move 2: D4", "field": "moves"})
+		case strings.HasPrefix(q.ID, "warn"):
+			out.Encode(map[string]string{"id": q.ID, "warning": "Unexpected or unused field", "field": "foo"})
+			answer(q)
+		case strings.HasPrefix(q.ID, "hold"):
+			held = append(held, q)
+			continue
+		case strings.HasPrefix(q.ID, "hang"):
+		case strings.HasPrefix(q.ID, "exit"):
+			os.Exit(0)
+		default:
+			answer(q)
+		}
+		for _, h := range held {
+			answer(h)
+		}
+		held = nil
+	}
+	for _, h := range held {
+		answer(h)
+	}
+}
+
+// startFakeKataGo starts a client with the fake engine, and returns it with
+// the path of the file that the engine writes its input to
+func startFakeKataGo(t *testing.T) (*KataGoClient, string) {
+	t.Helper()
+	logPath := filepath.Join(t.TempDir(), "input.jsonl")
+	t.Setenv("TOP3_FAKE_KATAGO", "1")
+	t.Setenv("TOP3_FAKE_KATAGO_LOG", logPath)
+	c, err := NewKataGoClient(os.Args[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, logPath
+}
+
+func submit(t *testing.T, ctx context.Context, c *KataGoClient, id string, turns ...int) *Query {
+	t.Helper()
+	q, err := c.Submit(ctx, AnalysisRequest{ID: id, AnalyzeTurns: turns})
+	if err != nil {
+		t.Fatalf("Submit(%s): %v", id, err)
+	}
+	return q
+}
+
+// turnsOf drains the responses of a query and returns their turns, in the
+// order they arrived
+func turnsOf(t *testing.T, q *Query) []int {
+	t.Helper()
+	turns := []int{}
+	for response := range q.Responses {
+		if response.ID != q.ID {
+			t.Errorf("query %s got a response for %s", q.ID, response.ID)
+		}
+		if response.IsDuringSearch {
+			t.Errorf("query %s got a response during the search", q.ID)
+		}
+		turns = append(turns, response.TurnNumber)
+	}
+	return turns
+}
+
+func TestKataGoClientResponses(t *testing.T) {
+	c, _ := startFakeKataGo(t)
+	ctx := context.Background()
+
+	// The responses for the first query arrive after those for the second
+	first := submit(t, ctx, c, "hold-1", 0, 1, 2)
+	if _, err := c.Submit(ctx, AnalysisRequest{ID: "hold-1"}); err == nil {
+		t.Error("Submit with the ID of a running query did not fail")
+	}
+	second := submit(t, ctx, c, "query-2", 3, 4)
+
+	if got, want := turnsOf(t, second), []int{4, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("turns of query-2 = %v; want %v", got, want)
+	}
+	if got, want := turnsOf(t, first), []int{2, 1, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("turns of hold-1 = %v; want %v", got, want)
+	}
+	for _, q := range []*Query{first, second} {
+		if q.Err() != nil {
+			t.Errorf("query %s: %v", q.ID, q.Err())
+		}
+	}
+}
+
+func TestKataGoClientError(t *testing.T) {
+	c, _ := startFakeKataGo(t)
+	q := submit(t, context.Background(), c, "error-1", 0, 1, 2)
+	if turns := turnsOf(t, q); len(turns) != 0 {
+		t.Errorf("turns = %v; want none", turns)
+	}
+	var kataGoErr *KataGoError
+	if !errors.As(q.Err(), &kataGoErr) {
+		t.Fatalf("Err() = %v; want a KataGoError", q.Err())
+	}
+	if index, ok := kataGoErr.IllegalMove(); !ok || index != 2 {
+		t.Errorf("IllegalMove() = %d, %t; want 2, true", index, ok)
+	}
+
+	// The client can still be used
+	if turns := turnsOf(t, submit(t, context.Background(), c, "query-2", 0)); len(turns) != 1 {
+		t.Errorf("turns after the error = %v; want [0]", turns)
+	}
+}
+
+func TestKataGoClientWarning(t *testing.T) {
+	c, _ := startFakeKataGo(t)
+	q := submit(t, context.Background(), c, "warn-1", 0, 1)
+	if got, want := turnsOf(t, q), []int{1, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("turns = %v; want %v", got, want)
+	}
+	if q.Err() != nil {
+		t.Errorf("Err() = %v; want nil", q.Err())
+	}
+	want := []KataGoWarning{{ID: "warn-1", Field: "foo", Message: "Unexpected or unused field"}}
+	if !reflect.DeepEqual(q.Warnings(), want) {
+		t.Errorf("Warnings() = %v; want %v", q.Warnings(), want)
+	}
+}
+
+func TestKataGoClientCancel(t *testing.T) {
+	c, logPath := startFakeKataGo(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	q := submit(t, ctx, c, "hang-1", 0)
+	cancel()
+	if turns := turnsOf(t, q); len(turns) != 0 {
+		t.Errorf("turns = %v; want none", turns)
+	}
+	if q.Err() != context.Canceled {
+		t.Errorf("Err() = %v; want %v", q.Err(), context.Canceled)
+	}
+
+	// KataGo is told to stop the query
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, _ := os.ReadFile(logPath)
+		if strings.Contains(string(data), `"action":"terminate","terminateId":"hang-1"`) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("KataGo was not told to terminate the query, it got:\n%s", data)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The ID can be used again, and a query with a context that is already
+	// canceled ends at once
+	q = submit(t, ctx, c, "hang-1", 0)
+	if turns := turnsOf(t, q); len(turns) != 0 {
+		t.Errorf("turns of the second hang-1 = %v; want none", turns)
+	}
+	if q.Err() != context.Canceled {
+		t.Errorf("Err() of the second hang-1 = %v; want %v", q.Err(), context.Canceled)
+	}
+}
+
+func TestKataGoClientExit(t *testing.T) {
+	c, _ := startFakeKataGo(t)
+	ctx := context.Background()
+	held := submit(t, ctx, c, "hold-1", 0)
+	exit := submit(t, ctx, c, "exit-2", 0)
+	for _, q := range []*Query{held, exit} {
+		if turns := turnsOf(t, q); len(turns) != 0 {
+			t.Errorf("turns of %s = %v; want none", q.ID, turns)
+		}
+		if q.Err() == nil {
+			t.Errorf("query %s did not fail when KataGo exited", q.ID)
+		}
+	}
+	if _, err := c.Submit(ctx, AnalysisRequest{ID: "query-3", AnalyzeTurns: []int{0}}); err == nil {
+		t.Error("Submit after KataGo exited did not fail")
+	}
+}
+
+func TestKataGoClientClose(t *testing.T) {
+	c, _ := startFakeKataGo(t)
+	ctx := context.Background()
+	q := submit(t, ctx, c, "hold-1", 0, 1)
+
+	// KataGo finishes the queries it has received before it exits
+	if err := c.Close(); err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+	if got, want := turnsOf(t, q), []int{1, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("turns = %v; want %v", got, want)
+	}
+	if q.Err() != nil {
+		t.Errorf("Err() = %v; want nil", q.Err())
+	}
+
+	if _, err := c.Submit(ctx, AnalysisRequest{ID: "query-2"}); !errors.Is(err, ErrClientClosed) {
+		t.Errorf("Submit after Close = %v; want %v", err, ErrClientClosed)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("second Close() = %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+// Package coord converts board coordinates between the SGF, GTP and KataGo
+// formats, for square and rectangular boards from 2x2 up to 25x25.
+package coord
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MinSize is the smallest supported board width or height
+	MinSize = 2
+	// MaxSize is the largest supported board width or height, limited by the
+	// number of GTP column letters
+	MaxSize = 25
+
+	// Pass is how a pass is written in GTP and by KataGo
+	Pass = "pass"
+)
+
+// gtpColumns are the GTP column letters, which skip the letter I
+const gtpColumns = "ABCDEFGHJKLMNOPQRSTUVWXYZ"
+
+// CheckSize returns an error if the board size is not supported
+func CheckSize(width, height int) error {
+	if width < MinSize || width > MaxSize || height < MinSize || height > MaxSize {
+		return fmt.Errorf("unsupported board size %dx%d", width, height)
+	}
+	return nil
+}
+
+// IsSGFPass returns true if the SGF coordinate is a pass. Both the empty
+// string and "tt" are passes, but "tt" only on boards up to 19x19, where it is
+// not a point on the board.
+func IsSGFPass(p string, width, height int) bool {
+	return p == "" || (p == "tt" && width <= 19 && height <= 19)
+}
+
+// IsGTPPass returns true if the GTP or KataGo coordinate is a pass
+func IsGTPPass(p string) bool {
+	return strings.EqualFold(strings.TrimSpace(p), Pass)
+}
+
+// SGFToXY converts an SGF coordinate (e.g. "dd") to zero-indexed x and y
+// values, counted from the top left corner. Passes are not points, so they
+// are reported as an error.
+func SGFToXY(p string, width, height int) (x, y int, err error) {
+	if err := CheckSize(width, height); err != nil {
+		return 0, 0, err
+	}
+	if len(p) != 2 {
+		return 0, 0, fmt.Errorf("invalid SGF point %q", p)
+	}
+	x, y = int(p[0])-'a', int(p[1])-'a'
+	if x < 0 || x >= width || y < 0 || y >= height {
+		return 0, 0, fmt.Errorf("SGF point %q is outside of a %dx%d board", p, width, height)
+	}
+	return x, y, nil
+}
+
+// XYToSGF converts zero-indexed x and y values, counted from the top left
+// corner, to an SGF coordinate
+func XYToSGF(x, y, width, height int) (string, error) {
+	if err := CheckSize(width, height); err != nil {
+		return "", err
+	}
+	if x < 0 || x >= width || y < 0 || y >= height {
+		return "", fmt.Errorf("point (%d,%d) is outside of a %dx%d board", x, y, width, height)
+	}
+	return string([]byte{byte('a' + x), byte('a' + y)}), nil
+}
+
+// GTPToXY converts a GTP coordinate (e.g. "D16") to zero-indexed x and y
+// values, counted from the top left corner. Passes are not points, so they
+// are reported as an error.
+func GTPToXY(p string, width, height int) (x, y int, err error) {
+	if err := CheckSize(width, height); err != nil {
+		return 0, 0, err
+	}
+	s := strings.ToUpper(strings.TrimSpace(p))
+	if len(s) < 2 {
+		return 0, 0, fmt.Errorf("invalid GTP point %q", p)
+	}
+	x = strings.IndexByte(gtpColumns, s[0])
+	row, err := strconv.Atoi(s[1:])
+	if x < 0 || err != nil || s[1] == '+' || s[1] == '-' {
+		return 0, 0, fmt.Errorf("invalid GTP point %q", p)
+	}
+	y = height - row
+	if x >= width || y < 0 || y >= height {
+		return 0, 0, fmt.Errorf("GTP point %q is outside of a %dx%d board", p, width, height)
+	}
+	return x, y, nil
+}
+
+// XYToGTP converts zero-indexed x and y values, counted from the top left
+// corner, to a GTP coordinate
+func XYToGTP(x, y, width, height int) (string, error) {
+	if err := CheckSize(width, height); err != nil {
+		return "", err
+	}
+	if x < 0 || x >= width || y < 0 || y >= height {
+		return "", fmt.Errorf("point (%d,%d) is outside of a %dx%d board", x, y, width, height)
+	}
+	return fmt.Sprintf("%c%d", gtpColumns[x], height-y), nil
+}
+
+// SGFToGTP converts an SGF coordinate to a GTP coordinate. Passes are
+// converted to "pass".
+func SGFToGTP(p string, width, height int) (string, error) {
+	if err := CheckSize(width, height); err != nil {
+		return "", err
+	}
+	if IsSGFPass(p, width, height) {
+		return Pass, nil
+	}
+	x, y, err := SGFToXY(p, width, height)
+	if err != nil {
+		return "", err
+	}
+	return XYToGTP(x, y, width, height)
+}
+
+// GTPToSGF converts a GTP coordinate to an SGF coordinate. Passes are
+// converted to the empty string.
+func GTPToSGF(p string, width, height int) (string, error) {
+	if err := CheckSize(width, height); err != nil {
+		return "", err
+	}
+	if IsGTPPass(p) {
+		return "", nil
+	}
+	x, y, err := GTPToXY(p, width, height)
+	if err != nil {
+		return "", err
+	}
+	return XYToSGF(x, y, width, height)
+}
+
+// SGFToKataGo converts an SGF coordinate to a coordinate for KataGo queries.
+// KataGo uses GTP coordinates for boards up to 25x25.
+func SGFToKataGo(p string, width, height int) (string, error) {
+	return SGFToGTP(p, width, height)
+}
+
+// KataGoToSGF converts a coordinate from a KataGo response, such as a move in
+// a principal variation, to an SGF coordinate. Besides GTP coordinates, the
+// "(x,y)" form that KataGo uses for large boards is accepted.
+func KataGoToSGF(p string, width, height int) (string, error) {
+	s := strings.TrimSpace(p)
+	if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		parts := strings.Split(s[1:len(s)-1], ",")
+		if len(parts) != 2 {
+			return "", fmt.Errorf("invalid KataGo point %q", p)
+		}
+		x, err1 := strconv.Atoi(strings.TrimSpace(parts[0]))
+		y, err2 := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err1 != nil || err2 != nil {
+			return "", fmt.Errorf("invalid KataGo point %q", p)
+		}
+		return XYToSGF(x, y, width, height)
+	}
+	return GTPToSGF(s, width, height)
+}
@@ -0,0 +1,117 @@
+package coord
+
+import "testing"
+
+func TestSGFToGTP(t *testing.T) {
+	tests := []struct {
+		sgf           string
+		width, height int
+		want          string
+		wantErr       bool
+	}{
+		{"aa", 19, 19, "A19", false},
+		{"ss", 19, 19, "T1", false},
+		{"dp", 19, 19, "D4", false},
+		{"ia", 19, 19, "J19", false}, // the I column is skipped
+		{"", 19, 19, "pass", false},
+		{"tt", 19, 19, "pass", false},
+		{"tt", 21, 21, "U2", false}, // "tt" is a point on larger boards
+		{"uu", 21, 21, "V1", false},
+		{"ma", 13, 9, "N9", false}, // rectangular boards
+		{"ai", 13, 9, "A1", false},
+		{"aj", 13, 9, "", true},
+		{"na", 13, 9, "", true},
+		{"a", 19, 19, "", true},
+		{"abc", 19, 19, "", true},
+		{"A1", 19, 19, "", true},
+		{"aa", 1, 1, "", true},
+		{"aa", 26, 26, "", true},
+	}
+	for _, tt := range tests {
+		got, err := SGFToGTP(tt.sgf, tt.width, tt.height)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("SGFToGTP(%q, %d, %d) = %q, %v; want %q, error %v", tt.sgf, tt.width, tt.height, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestGTPToSGF(t *testing.T) {
+	tests := []struct {
+		gtp           string
+		width, height int
+		want          string
+		wantErr       bool
+	}{
+		{"A19", 19, 19, "aa", false},
+		{"d4", 19, 19, "dp", false},
+		{" Q16 ", 19, 19, "pd", false},
+		{"J19", 19, 19, "ia", false},
+		{"pass", 19, 19, "", false},
+		{"PASS", 19, 19, "", false},
+		{"N9", 13, 9, "ma", false},
+		{"I5", 19, 19, "", true}, // there is no I column
+		{"A", 19, 19, "", true},
+		{"A20", 19, 19, "", true},
+		{"A0", 19, 19, "", true},
+		{"A-1", 19, 19, "", true},
+		{"A+1", 19, 19, "", true},
+		{"O1", 13, 9, "", true},
+		{"A10", 13, 9, "", true},
+		{"11", 19, 19, "", true},
+	}
+	for _, tt := range tests {
+		got, err := GTPToSGF(tt.gtp, tt.width, tt.height)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("GTPToSGF(%q, %d, %d) = %q, %v; want %q, error %v", tt.gtp, tt.width, tt.height, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestKataGoToSGF(t *testing.T) {
+	tests := []struct {
+		katago        string
+		width, height int
+		want          string
+		wantErr       bool
+	}{
+		{"Q16", 19, 19, "pd", false},
+		{"pass", 19, 19, "", false},
+		{"(3,15)", 19, 19, "dp", false},
+		{"( 12 , 0 )", 13, 9, "ma", false},
+		{"(13,0)", 13, 9, "", true},
+		{"(1)", 19, 19, "", true},
+		{"(a,b)", 19, 19, "", true},
+	}
+	for _, tt := range tests {
+		got, err := KataGoToSGF(tt.katago, tt.width, tt.height)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("KataGoToSGF(%q, %d, %d) = %q, %v; want %q, error %v", tt.katago, tt.width, tt.height, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, size := range [][2]int{{9, 9}, {19, 19}, {25, 25}, {13, 7}, {2, 25}} {
+		width, height := size[0], size[1]
+		for x := 0; x < width; x++ {
+			for y := 0; y < height; y++ {
+				gtp, err := XYToGTP(x, y, width, height)
+				if err != nil {
+					t.Fatalf("XYToGTP(%d, %d, %d, %d): %v", x, y, width, height, err)
+				}
+				gx, gy, err := GTPToXY(gtp, width, height)
+				if err != nil || gx != x || gy != y {
+					t.Errorf("GTPToXY(%q, %d, %d) = %d, %d, %v; want %d, %d", gtp, width, height, gx, gy, err, x, y)
+				}
+				p, err := XYToSGF(x, y, width, height)
+				if err != nil {
+					t.Fatalf("XYToSGF(%d, %d, %d, %d): %v", x, y, width, height, err)
+				}
+				sx, sy, err := SGFToXY(p, width, height)
+				if err != nil || sx != x || sy != y {
+					t.Errorf("SGFToXY(%q, %d, %d) = %d, %d, %v; want %d, %d", p, width, height, sx, sy, err, x, y)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,404 @@
+// Package diagram draws Go board diagrams of any size as SVG images, with
+// overlays for the last move, engine candidates, variations and ownership
+package diagram
+
+import (
+	"fmt"
+	"html"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/rooklift/sgf"
+)
+
+// Color is the color of a stone, or Empty
+type Color int8
+
+// Stone colors
+const (
+	Empty Color = iota
+	Black
+	White
+)
+
+// Point is a point on the board. X counts from the left and Y from the top,
+// both starting at 0, as in SGF coordinates.
+type Point struct {
+	X, Y int
+}
+
+// Shapes of marks
+const (
+	Circle   = "circle"
+	Triangle = "triangle"
+	Square   = "square"
+	Cross    = "cross"
+)
+
+// Mark is a shape drawn on a point, such as a circle on the last move
+type Mark struct {
+	Point
+	Shape string
+}
+
+// Label is text drawn on a point, such as a letter for a candidate move
+type Label struct {
+	Point
+	Text string
+}
+
+// Candidate is a move suggested by an engine, drawn as a colored disc with a
+// label such as a letter or a winrate
+type Candidate struct {
+	Point
+	Label string
+	// Best is true for the first choice of the engine, which is drawn in a
+	// different color
+	Best bool
+}
+
+// Move is a stone of a variation
+type Move struct {
+	Point
+	Color Color
+}
+
+// Region is a rectangle of points, from Min to Max
+type Region struct {
+	Min, Max Point
+}
+
+// Board is a position together with the markup to draw on it
+type Board struct {
+	Width, Height int
+	Stones        [][]Color // indexed by x, then y
+	Marks         []Mark
+	Labels        []Label
+
+	// LastMove is marked with a circle, if it is set
+	LastMove *Point
+
+	// Candidates are drawn on empty points
+	Candidates []Candidate
+
+	// Variation is drawn as stones numbered from 1, on top of the position.
+	// Stones that a later move of the variation would capture are not
+	// removed.
+	Variation []Move
+
+	// Ownership shades the points by who is expected to own them at the end
+	// of the game, from -1 for White to 1 for Black. It is indexed by x, then
+	// y, like Stones.
+	Ownership [][]float64
+
+	// Crop draws only part of the board, if it is set
+	Crop *Region
+
+	// Coordinates draws the letters and numbers around the board
+	Coordinates bool
+}
+
+const (
+	// cell is the distance between two lines of the board, in pixels
+	cell = 24
+	// margin is the space around the grid without coordinates
+	margin = cell
+	// coordinateMargin is the space around the grid with coordinates
+	coordinateMargin = cell * 3 / 2
+	// columnLetters are the letters of the columns, which skip I
+	columnLetters = "ABCDEFGHJKLMNOPQRSTUVWXYZ"
+	boardColor    = "#dcb35c"
+	// candidateColor and bestColor are the colors of the candidates
+	candidateColor = "#4a90d9"
+	bestColor      = "#3a3"
+	// minOwnership is the smallest ownership that is shown
+	minOwnership = 0.05
+)
+
+// New returns an empty board
+func New(width, height int) *Board {
+	stones := make([][]Color, width)
+	for x := range stones {
+		stones[x] = make([]Color, height)
+	}
+	return &Board{Width: width, Height: height, Stones: stones}
+}
+
+// FromSGF returns a board with the position of an SGF board
+func FromSGF(position *sgf.Board) *Board {
+	b := New(position.Size, position.Size)
+	for x := 0; x < position.Size; x++ {
+		for y := 0; y < position.Size; y++ {
+			switch position.State[x][y] {
+			case sgf.BLACK:
+				b.Stones[x][y] = Black
+			case sgf.WHITE:
+				b.Stones[x][y] = White
+			}
+		}
+	}
+	return b
+}
+
+// Set places a stone on the board, or removes it with Empty. Points outside
+// the board are ignored.
+func (b *Board) Set(p Point, c Color) {
+	if b.onBoard(p) {
+		b.Stones[p.X][p.Y] = c
+	}
+}
+
+// At returns the stone on a point, or Empty
+func (b *Board) At(p Point) Color {
+	if !b.onBoard(p) {
+		return Empty
+	}
+	return b.Stones[p.X][p.Y]
+}
+
+// onBoard returns true if the point is on the board
+func (b *Board) onBoard(p Point) bool {
+	return p.X >= 0 && p.Y >= 0 && p.X < b.Width && p.Y < b.Height
+}
+
+// region returns the part of the board that is drawn
+func (b *Board) region() Region {
+	r := Region{Max: Point{b.Width - 1, b.Height - 1}}
+	if b.Crop != nil {
+		r.Min.X = max(min(b.Crop.Min.X, b.Crop.Max.X), 0)
+		r.Min.Y = max(min(b.Crop.Min.Y, b.Crop.Max.Y), 0)
+		r.Max.X = min(max(b.Crop.Min.X, b.Crop.Max.X), b.Width-1)
+		r.Max.Y = min(max(b.Crop.Min.Y, b.Crop.Max.Y), b.Height-1)
+	}
+	return r
+}
+
+// Contains returns true if the point is in the region
+func (r Region) Contains(p Point) bool {
+	return p.X >= r.Min.X && p.X <= r.Max.X && p.Y >= r.Min.Y && p.Y <= r.Max.Y
+}
+
+// SVG draws the board as an SVG image
+func (b *Board) SVG() string {
+	m := margin
+	if b.Coordinates {
+		m = coordinateMargin
+	}
+	r := b.region()
+	if r.Min.X > r.Max.X || r.Min.Y > r.Max.Y {
+		return ""
+	}
+	width := 2*m + (r.Max.X-r.Min.X)*cell
+	height := 2*m + (r.Max.Y-r.Min.Y)*cell
+	posX := func(x int) int { return m + (x-r.Min.X)*cell }
+	posY := func(y int) int { return m + (y-r.Min.Y)*cell }
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif">`, width, height, width, height)
+	fmt.Fprintf(&sb, `<rect width="%d" height="%d" fill="%s"/>`, width, height, boardColor)
+
+	// Grid and star points. Lines that go on outside of a cropped region
+	// stick out a little.
+	top, bottom := posY(r.Min.Y), posY(r.Max.Y)
+	left, right := posX(r.Min.X), posX(r.Max.X)
+	if r.Min.Y > 0 {
+		top -= cell / 2
+	}
+	if r.Max.Y < b.Height-1 {
+		bottom += cell / 2
+	}
+	if r.Min.X > 0 {
+		left -= cell / 2
+	}
+	if r.Max.X < b.Width-1 {
+		right += cell / 2
+	}
+	for x := r.Min.X; x <= r.Max.X; x++ {
+		fmt.Fprintf(&sb, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#000" stroke-width="1"/>`, posX(x), top, posX(x), bottom)
+	}
+	for y := r.Min.Y; y <= r.Max.Y; y++ {
+		fmt.Fprintf(&sb, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#000" stroke-width="1"/>`, left, posY(y), right, posY(y))
+	}
+	for _, p := range starPoints(b.Width, b.Height) {
+		if r.Contains(p) {
+			fmt.Fprintf(&sb, `<circle cx="%d" cy="%d" r="3" fill="#000"/>`, posX(p.X), posY(p.Y))
+		}
+	}
+
+	if b.Coordinates {
+		for x := r.Min.X; x <= r.Max.X; x++ {
+			for _, y := range []int{m / 2, height - m/2} {
+				fmt.Fprintf(&sb, `<text x="%d" y="%d" font-size="12" text-anchor="middle" dominant-baseline="central">%s</text>`, posX(x), y, columnLabel(x))
+			}
+		}
+		for y := r.Min.Y; y <= r.Max.Y; y++ {
+			number := b.Height - y
+			for _, x := range []int{m / 2, width - m/2} {
+				fmt.Fprintf(&sb, `<text x="%d" y="%d" font-size="12" text-anchor="middle" dominant-baseline="central">%d</text>`, x, posY(y), number)
+			}
+		}
+	}
+
+	// Stones
+	for x := r.Min.X; x <= r.Max.X; x++ {
+		for y := r.Min.Y; y <= r.Max.Y; y++ {
+			writeStone(&sb, posX(x), posY(y), b.Stones[x][y])
+		}
+	}
+
+	// Ownership is shown on empty points and on stones that are expected to
+	// be captured
+	for x := r.Min.X; x <= r.Max.X && x < len(b.Ownership); x++ {
+		for y := r.Min.Y; y <= r.Max.Y && y < len(b.Ownership[x]); y++ {
+			owner, fill := Black, "#000"
+			if b.Ownership[x][y] < 0 {
+				owner, fill = White, "#fff"
+			}
+			if b.Stones[x][y] == owner || math.Abs(b.Ownership[x][y]) < minOwnership {
+				continue
+			}
+			opacity := math.Min(math.Abs(b.Ownership[x][y]), 1) * 0.8
+			size := cell / 2
+			fmt.Fprintf(&sb, `<rect x="%d" y="%d" width="%d" height="%d" fill="%s" fill-opacity="%.2f"/>`, posX(x)-size/2, posY(y)-size/2, size, size, fill, opacity)
+		}
+	}
+
+	for _, c := range b.Candidates {
+		if !r.Contains(c.Point) || b.At(c.Point) != Empty {
+			continue
+		}
+		color := candidateColor
+		if c.Best {
+			color = bestColor
+		}
+		cx, cy := posX(c.X), posY(c.Y)
+		fmt.Fprintf(&sb, `<circle cx="%d" cy="%d" r="%d" fill="%s" fill-opacity="0.85"/>`, cx, cy, cell/2-1, color)
+		if c.Label != "" {
+			fmt.Fprintf(&sb, `<text x="%d" y="%d" font-size="%d" text-anchor="middle" dominant-baseline="central" fill="#fff">%s</text>`, cx, cy, labelSize(c.Label), html.EscapeString(c.Label))
+		}
+	}
+
+	// The stones of the variation are numbered in the color that stands out
+	// from the stone
+	for i, move := range b.Variation {
+		if !r.Contains(move.Point) || move.Color == Empty {
+			continue
+		}
+		cx, cy := posX(move.X), posY(move.Y)
+		color := "#000"
+		if move.Color == Black {
+			color = "#fff"
+		}
+		number := strconv.Itoa(i + 1)
+		writeStone(&sb, cx, cy, move.Color)
+		fmt.Fprintf(&sb, `<text x="%d" y="%d" font-size="%d" text-anchor="middle" dominant-baseline="central" fill="%s">%s</text>`, cx, cy, labelSize(number), color, number)
+	}
+
+	// Marks and labels are drawn in a color that stands out from the stone
+	// under them
+	marks := b.Marks
+	if b.LastMove != nil {
+		marks = append([]Mark{{Point: *b.LastMove, Shape: Circle}}, marks...)
+	}
+	for _, mark := range marks {
+		if !b.onBoard(mark.Point) || !r.Contains(mark.Point) {
+			continue
+		}
+		cx, cy := posX(mark.X), posY(mark.Y)
+		color := b.markColor(mark.Point)
+		size := cell / 4
+		switch mark.Shape {
+		case Circle:
+			fmt.Fprintf(&sb, `<circle cx="%d" cy="%d" r="%d" fill="none" stroke="%s" stroke-width="2"/>`, cx, cy, size, color)
+		case Triangle:
+			fmt.Fprintf(&sb, `<polygon points="%d,%d %d,%d %d,%d" fill="none" stroke="%s" stroke-width="2"/>`, cx, cy-size, cx-size, cy+size*3/4, cx+size, cy+size*3/4, color)
+		case Square:
+			fmt.Fprintf(&sb, `<rect x="%d" y="%d" width="%d" height="%d" fill="none" stroke="%s" stroke-width="2"/>`, cx-size, cy-size, 2*size, 2*size, color)
+		case Cross:
+			fmt.Fprintf(&sb, `<path d="M%d %dL%d %dM%d %dL%d %d" stroke="%s" stroke-width="2"/>`, cx-size, cy-size, cx+size, cy+size, cx+size, cy-size, cx-size, cy+size, color)
+		}
+	}
+	for _, label := range b.Labels {
+		if !b.onBoard(label.Point) || !r.Contains(label.Point) {
+			continue
+		}
+		cx, cy := posX(label.X), posY(label.Y)
+		if b.At(label.Point) == Empty {
+			// Hide the grid under the label
+			fmt.Fprintf(&sb, `<circle cx="%d" cy="%d" r="%d" fill="%s"/>`, cx, cy, cell/2-2, boardColor)
+		}
+		fmt.Fprintf(&sb, `<text x="%d" y="%d" font-size="%d" text-anchor="middle" dominant-baseline="central" fill="%s">%s</text>`, cx, cy, labelSize(label.Text), b.markColor(label.Point), html.EscapeString(label.Text))
+	}
+
+	sb.WriteString("</svg>")
+	return sb.String()
+}
+
+// writeStone draws a stone, if the color is not Empty
+func writeStone(sb *strings.Builder, cx, cy int, c Color) {
+	switch c {
+	case Black:
+		fmt.Fprintf(sb, `<circle cx="%d" cy="%d" r="%d" fill="#000"/>`, cx, cy, cell/2-1)
+	case White:
+		fmt.Fprintf(sb, `<circle cx="%d" cy="%d" r="%d" fill="#fff" stroke="#000" stroke-width="1"/>`, cx, cy, cell/2-1)
+	}
+}
+
+// columnLabel returns the letter of a column, or its number on boards that
+// are too wide for letters
+func columnLabel(x int) string {
+	if x < len(columnLetters) {
+		return columnLetters[x : x+1]
+	}
+	return strconv.Itoa(x + 1)
+}
+
+// markColor returns the color for markup on a point
+func (b *Board) markColor(p Point) string {
+	if b.At(p) == Black {
+		return "#fff"
+	}
+	return "#000"
+}
+
+// labelSize returns a font size that fits the label in a cell
+func labelSize(text string) int {
+	switch n := len([]rune(text)); {
+	case n <= 1:
+		return 14
+	case n == 2:
+		return 12
+	case n == 3:
+		return 10
+	}
+	return 8
+}
+
+// starPoints returns the star points of the usual board sizes
+func starPoints(width, height int) []Point {
+	if width != height {
+		return nil
+	}
+	var lines []int
+	switch width {
+	case 9:
+		lines = []int{2, 6}
+	case 13:
+		lines = []int{3, 9}
+	case 19:
+		lines = []int{3, 9, 15}
+	default:
+		return nil
+	}
+	points := make([]Point, 0, len(lines)*len(lines)+1)
+	for _, x := range lines {
+		for _, y := range lines {
+			points = append(points, Point{x, y})
+		}
+	}
+	if width == 9 || width == 13 {
+		points = append(points, Point{width / 2, width / 2})
+	}
+	return points
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Perspectives of the winrates and score leads that KataGo reports, as set
+// by reportAnalysisWinratesAs in its config
+const (
+	sideToMove = "SIDETOMOVE"
+	blackSide  = "BLACK"
+	whiteSide  = "WHITE"
+)
+
+// reportAsPattern finds reportAnalysisWinratesAs in a KataGo config file
+var reportAsPattern = regexp.MustCompile(`(?m)^\s*reportAnalysisWinratesAs\s*=\s*(\w+)`)
+
+// kataGoPerspective returns the perspective of the values that KataGo
+// reports, from -override-config or the config file in the KataGo
+// arguments. KataGo reports values for the side to move by default.
+func kataGoPerspective(opts Options) string {
+	args := strings.Fields(opts.KataGo.Arguments)
+	configFile := opts.KataGo.Config
+	for i := 0; i+1 < len(args); i++ {
+		switch args[i] {
+		case "-override-config":
+			for _, setting := range strings.Split(args[i+1], ",") {
+				key, value, _ := strings.Cut(setting, "=")
+				if strings.TrimSpace(key) == "reportAnalysisWinratesAs" {
+					return strings.ToUpper(strings.TrimSpace(value))
+				}
+			}
+		case "-config":
+			configFile = args[i+1]
+		}
+	}
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return sideToMove
+	}
+	if m := reportAsPattern.FindSubmatch(data); m != nil {
+		return strings.ToUpper(string(m[1]))
+	}
+	return sideToMove
+}
+
+// reportedSide returns the player that the values of a response are seen
+// from. toMove is the player to move in the position, which is used when the
+// response does not tell.
+func reportedSide(response AnalysisResponse, toMove, perspective string) string {
+	switch perspective {
+	case blackSide:
+		return "black"
+	case whiteSide:
+		return "white"
+	}
+	switch response.RootInfo.CurrentPlayer {
+	case "B":
+		return "black"
+	case "W":
+		return "white"
+	}
+	return toMove
+}
+
+// forPlayer turns a winrate and score lead seen from side into the values
+// seen from player
+func forPlayer(winrate, scoreLead float64, side, player string) (float64, float64) {
+	if side != player {
+		return 1 - winrate, -scoreLead
+	}
+	return winrate, scoreLead
+}
+
+// playerValues returns the winrate and score lead of the root of a response,
+// seen from the given player. toMove is the player to move in the position,
+// which is used when the response does not tell.
+func playerValues(response AnalysisResponse, player, toMove, perspective string) (winrate, scoreLead float64) {
+	side := reportedSide(response, toMove, perspective)
+	return forPlayer(response.RootInfo.Winrate, response.RootInfo.ScoreLead, side, player)
+}
+
+// opponent returns the other player
+func opponent(player string) string {
+	if player == "black" {
+		return "white"
+	}
+	return "black"
+}
+
+// moveLoss returns the winrate and score lead of the player after the move,
+// and how much of them the move lost. The loss is the value of the position
+// before the move minus the value after it, both seen from the player.
+func moveLoss(before, after AnalysisResponse, player, perspective string) (winrate, drop, scoreLead, scoreDrop float64) {
+	winrateBefore, scoreBefore := playerValues(before, player, player, perspective)
+	winrate, scoreLead = playerValues(after, player, opponent(player), perspective)
+	return winrate, winrateBefore - winrate, scoreLead, scoreBefore - scoreLead
+}
+
+// evaluateMoves evaluates every move that has responses for the positions
+// before and after it. Moves without both responses and skipped moves are
+// left out.
+func evaluateMoves(positions []Position, analysis *Analysis) []MoveInfo {
+	moveEvaluations := make([]MoveInfo, 0, len(positions))
+	for _, pos := range positions {
+		before, okBefore := analysis.Responses[pos.Before]
+		after, okAfter := analysis.Responses[pos.Path]
+		if !okBefore || !okAfter || analysis.skipReason(pos) != "" {
+			continue
+		}
+		moveInfo := newMoveInfo(pos)
+		moveInfo.Winrate, moveInfo.Drop, moveInfo.ScoreLead, moveInfo.ScoreDrop = moveLoss(before, after, moveInfo.Player, analysis.Perspective)
+		moveInfo.TopChoice, moveInfo.Margin, moveInfo.MarginPoints = topChoice(before, moveInfo.Move)
+
+		// With -r, the drop of the first pass is kept for comparison
+		firstBefore, revisitedBefore := analysis.FirstPass[pos.Before]
+		firstAfter, revisitedAfter := analysis.FirstPass[pos.Path]
+		if revisitedBefore || revisitedAfter {
+			if !revisitedBefore {
+				firstBefore = before
+			}
+			if !revisitedAfter {
+				firstAfter = after
+			}
+			moveInfo.Revisited = true
+			_, moveInfo.FirstPassDrop, _, moveInfo.FirstPassScoreDrop = moveLoss(firstBefore, firstAfter, moveInfo.Player, analysis.Perspective)
+		}
+		moveEvaluations = append(moveEvaluations, moveInfo)
+	}
+	return moveEvaluations
+}
+
+// skippedMoves returns the moves that could not be evaluated because KataGo
+// had no results for the position after them
+func skippedMoves(positions []Position, analysis *Analysis) []MoveInfo {
+	skipped := make([]MoveInfo, 0)
+	for _, pos := range positions {
+		if reason := analysis.skipReason(pos); reason != "" {
+			moveInfo := newMoveInfo(pos)
+			moveInfo.Skipped = reason
+			skipped = append(skipped, moveInfo)
+		}
+	}
+	return skipped
+}
+
+// warnedMoves returns the moves that KataGo reported warnings for. Warnings
+// for the position before the first move are returned as move 0.
+func warnedMoves(lines []Line, positions []Position, analysis *Analysis) []MoveInfo {
+	warned := make([]MoveInfo, 0)
+	if len(lines) > 0 && len(lines[0].Paths) > 0 {
+		root := lines[0].Paths[0]
+		if warnings := analysis.Warnings[root]; len(warnings) > 0 {
+			warned = append(warned, MoveInfo{Path: root, Warnings: warnings})
+		}
+	}
+	for _, pos := range positions {
+		if warnings := analysis.Warnings[pos.Path]; len(warnings) > 0 {
+			moveInfo := newMoveInfo(pos)
+			moveInfo.Warnings = warnings
+			warned = append(warned, moveInfo)
+		}
+	}
+	return warned
+}
+
+// newMoveInfo creates the move information of a position, without an
+// evaluation
+func newMoveInfo(pos Position) MoveInfo {
+	turn := len(pos.Moves) - 1
+	return MoveInfo{
+		Path:       pos.Path,
+		Variation:  pos.Variation,
+		MoveNumber: pos.MoveNumber,
+		Player:     pos.Moves[turn][0],
+		Move:       pos.Moves[turn][1],
+	}
+}
+
+// Ways of ranking moves, for the rankBy option
+const (
+	rankByWinrate = "winrate"
+	rankByPoints  = "points"
+	rankByBlended = "blended"
+)
+
+// validRankBy returns true if the rankBy option is known. Empty means the
+// default, which is ranking by winrate.
+func validRankBy(rankBy string) bool {
+	switch rankBy {
+	case "", rankByWinrate, rankByPoints, rankByBlended:
+		return true
+	}
+	return false
+}
+
+// lossMetric returns the loss of a move that moves are ranked by. The
+// blended metric adds the winrate drop in percent to the points lost, so
+// that a blunder counts even when the game is already decided.
+func lossMetric(move MoveInfo, rankBy string) float64 {
+	switch rankBy {
+	case rankByPoints:
+		return move.ScoreDrop
+	case rankByBlended:
+		return move.Drop*100 + move.ScoreDrop
+	}
+	return move.Drop
+}
+
+// topChoice returns true if the move was the first choice of KataGo in the
+// position, together with how much better it was than the second choice in
+// winrate and points
+func topChoice(before AnalysisResponse, move string) (bool, float64, float64) {
+	candidates := sortedCandidates(before)
+	if len(candidates) == 0 || !strings.EqualFold(candidates[0].Move, move) {
+		return false, 0, 0
+	}
+	if len(candidates) == 1 {
+		return true, 0, 0
+	}
+	return true, math.Abs(candidates[0].Winrate - candidates[1].Winrate), math.Abs(candidates[0].ScoreLead - candidates[1].ScoreLead)
+}
+
+// gainMetric returns the value that best moves are ranked by. It is the loss
+// of the move turned around, plus how critical the position was if the move
+// was KataGo's first choice.
+func gainMetric(move MoveInfo, rankBy string) float64 {
+	gain := -lossMetric(move, rankBy)
+	if move.TopChoice {
+		gain += lossMetric(MoveInfo{Drop: move.Margin, ScoreDrop: move.MarginPoints}, rankBy)
+	}
+	return gain
+}
+
+// sortMoves sorts moves by a metric in descending order. Ties are broken by
+// move number, then by the path in the game tree, so that the order is the
+// same for every run.
+func sortMoves(moves []MoveInfo, metric func(MoveInfo) float64) {
+	sort.SliceStable(moves, func(i, j int) bool {
+		mi, mj := metric(moves[i]), metric(moves[j])
+		if mi != mj {
+			return mi > mj
+		}
+		if moves[i].MoveNumber != moves[j].MoveNumber {
+			return moves[i].MoveNumber < moves[j].MoveNumber
+		}
+		return moves[i].Path < moves[j].Path
+	})
+}
+
+// findWorstMoves finds the worst moves, ranked by winrate drop, points lost
+// or a blend of the two. Only moves that lost something are listed. The
+// given moves are left as they are.
+func findWorstMoves(moveEvaluations []MoveInfo, num int, rankBy string) []MoveInfo {
+	moves := make([]MoveInfo, 0)
+	for _, move := range moveEvaluations {
+		if lossMetric(move, rankBy) > 0 {
+			moves = append(moves, move)
+		}
+	}
+	sortMoves(moves, func(m MoveInfo) float64 { return lossMetric(m, rankBy) })
+	return moves[:min(num, len(moves))]
+}
+
+// findBestMoves finds the best moves, which gained the most against
+// expectation or were KataGo's first choice in a critical position. Only
+// good moves and KataGo's first choices are listed. The given moves are left
+// as they are.
+func findBestMoves(moveEvaluations []MoveInfo, num int, rankBy string) []MoveInfo {
+	moves := make([]MoveInfo, 0)
+	for _, move := range moveEvaluations {
+		if move.Class == classGood || move.TopChoice {
+			moves = append(moves, move)
+		}
+	}
+	sortMoves(moves, func(m MoveInfo) float64 { return gainMetric(m, rankBy) })
+	return moves[:min(num, len(moves))]
+}
+
+// Move classes, from the winrate drop thresholds in the sgf options
+const (
+	classGood    = "good"
+	classNeutral = "neutral"
+	classBad     = "bad"
+	classHotSpot = "hotspot"
+)
+
+// classifyMove classifies a move by its winrate drop. The thresholds are in
+// percent.
+func classifyMove(move MoveInfo, opts Options) string {
+	drop := move.Drop * 100
+	switch {
+	case drop >= opts.SGF.MinWinRateDropForBadHotSpot:
+		return classHotSpot
+	case drop >= opts.SGF.MinWinRateDropForBadMove:
+		return classBad
+	case drop <= opts.SGF.MaxWinRateDropForGoodMove:
+		return classGood
+	}
+	return classNeutral
+}
+
+// classifyMoves sets the class of every evaluated move
+func classifyMoves(moveEvaluations []MoveInfo, opts Options) {
+	for i := range moveEvaluations {
+		moveEvaluations[i].Class = classifyMove(moveEvaluations[i], opts)
+	}
+}
+
+// mainLineMoves returns the moves of the main line. The moves of the side
+// variations of a game record are not played by the players, so they are
+// left out of the counts and rankings.
+func mainLineMoves(moveEvaluations []MoveInfo) []MoveInfo {
+	moves := make([]MoveInfo, 0, len(moveEvaluations))
+	for _, move := range moveEvaluations {
+		if move.Variation == 0 {
+			moves = append(moves, move)
+		}
+	}
+	return moves
+}
+
+// countClasses counts the moves of each class for each player, on the main
+// line
+func countClasses(moveEvaluations []MoveInfo) map[string]map[string]int {
+	counts := make(map[string]map[string]int, len(players))
+	for _, player := range players {
+		counts[player] = make(map[string]int)
+	}
+	for _, move := range mainLineMoves(moveEvaluations) {
+		if counts[move.Player] != nil {
+			counts[move.Player][move.Class]++
+		}
+	}
+	return counts
+}
+
+// players are the players in the order they are reported
+var players = []string{"black", "white"}
+
+// PlayerMoves holds the worst and best moves of a player
+type PlayerMoves struct {
+	Worst []MoveInfo
+	Best  []MoveInfo
+}
+
+// rankMoves finds the worst and best moves of each player on the main line.
+// A move that is among the worst moves is never among the best moves.
+func rankMoves(moveEvaluations []MoveInfo, num int, rankBy string) map[string]PlayerMoves {
+	ranked := make(map[string]PlayerMoves, len(players))
+	for _, player := range players {
+		moves := make([]MoveInfo, 0)
+		for _, move := range mainLineMoves(moveEvaluations) {
+			if move.Player == player {
+				moves = append(moves, move)
+			}
+		}
+		worst := findWorstMoves(moves, num, rankBy)
+		listed := make(map[string]bool, len(worst))
+		for _, move := range worst {
+			listed[move.Path] = true
+		}
+		candidates := make([]MoveInfo, 0, len(moves))
+		for _, move := range moves {
+			if !listed[move.Path] {
+				candidates = append(candidates, move)
+			}
+		}
+		ranked[player] = PlayerMoves{
+			Worst: worst,
+			Best:  findBestMoves(candidates, num, rankBy),
+		}
+	}
+	return ranked
+}
+
+// describeMove describes an evaluated move for the console output
+func describeMove(move MoveInfo) string {
+	s := fmt.Sprintf("move %d (%s), %s with winrate drop %.2f%% and %.1f points lost", move.MoveNumber, variationName(move.Variation), move.Move, move.Drop*100, move.ScoreDrop)
+	if move.Class != "" {
+		s += " [" + move.Class + "]"
+	}
+	if move.Revisited {
+		s += fmt.Sprintf(" (first pass %.2f%% and %.1f points)", move.FirstPassDrop*100, move.FirstPassScoreDrop)
+	}
+	if move.TopChoice {
+		s += fmt.Sprintf(", KataGo's first choice by %.2f%%", move.Margin*100)
+	}
+	return s
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// response returns a response with the given root values
+func response(winrate, scoreLead float64, currentPlayer string) AnalysisResponse {
+	return AnalysisResponse{RootInfo: RootInfo{Winrate: winrate, ScoreLead: scoreLead, CurrentPlayer: currentPlayer}}
+}
+
+func TestMoveLoss(t *testing.T) {
+	// Black has 60% and leads by 3 points before the move, and 45% and is
+	// behind by 1 point after it. White's move is the same game with the
+	// colors swapped. Every case reports these values in another way.
+	tests := []struct {
+		name          string
+		player        string
+		perspective   string
+		before, after AnalysisResponse
+	}{
+		{"black, side to move", "black", sideToMove, response(0.60, 3, "B"), response(0.55, 1, "W")},
+		{"black, side to move without current player", "black", sideToMove, response(0.60, 3, ""), response(0.55, 1, "")},
+		{"black, empty perspective", "black", "", response(0.60, 3, ""), response(0.55, 1, "")},
+		{"black, black", "black", blackSide, response(0.60, 3, "B"), response(0.45, -1, "W")},
+		{"black, white", "black", whiteSide, response(0.40, -3, "B"), response(0.55, 1, "W")},
+		{"white, side to move", "white", sideToMove, response(0.60, 3, "W"), response(0.55, 1, "B")},
+		{"white, side to move without current player", "white", sideToMove, response(0.60, 3, ""), response(0.55, 1, "")},
+		{"white, black", "white", blackSide, response(0.40, -3, "W"), response(0.55, 1, "B")},
+		{"white, white", "white", whiteSide, response(0.60, 3, "W"), response(0.45, -1, "B")},
+	}
+	const (
+		wantWinrate   = 0.45
+		wantDrop      = 0.15
+		wantScoreLead = -1.0
+		wantScoreDrop = 4.0
+	)
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+	for _, tt := range tests {
+		winrate, drop, scoreLead, scoreDrop := moveLoss(tt.before, tt.after, tt.player, tt.perspective)
+		if !near(winrate, wantWinrate) || !near(drop, wantDrop) || !near(scoreLead, wantScoreLead) || !near(scoreDrop, wantScoreDrop) {
+			t.Errorf("%s: moveLoss = %.2f, %.2f, %.1f, %.1f; want %.2f, %.2f, %.1f, %.1f", tt.name, winrate, drop, scoreLead, scoreDrop, wantWinrate, wantDrop, wantScoreLead, wantScoreDrop)
+		}
+	}
+}
+
+func TestMoveLossCurrentPlayer(t *testing.T) {
+	// With SIDETOMOVE, the current player of the response decides whose
+	// values they are, even if the move order of the game says otherwise,
+	// such as after two moves in a row by the same player
+	before := response(0.60, 3, "B")
+	after := response(0.45, -1, "B")
+	winrate, drop, _, _ := moveLoss(before, after, "black", sideToMove)
+	if math.Abs(winrate-0.45) > 1e-9 || math.Abs(drop-0.15) > 1e-9 {
+		t.Errorf("moveLoss = %.2f, %.2f; want 0.45, 0.15", winrate, drop)
+	}
+}
+
+// paths returns the paths of moves
+func paths(moves []MoveInfo) []string {
+	result := make([]string, 0, len(moves))
+	for _, move := range moves {
+		result = append(result, move.Path)
+	}
+	return result
+}
+
+func TestRankMoves(t *testing.T) {
+	moves := []MoveInfo{
+		{Path: "1", MoveNumber: 1, Player: "black", Drop: 0.10, Class: classBad},
+		{Path: "2", MoveNumber: 2, Player: "white", Drop: 0.20, Class: classHotSpot},
+		{Path: "3", MoveNumber: 3, Player: "black", Drop: 0.02, Class: classNeutral, TopChoice: true, Margin: 0.05},
+		{Path: "5", MoveNumber: 5, Player: "black", Drop: -0.01, Class: classGood},
+		{Path: "7", MoveNumber: 7, Player: "black", Drop: 0, Class: classGood},
+		{Path: "9", MoveNumber: 9, Player: "black", Drop: 0.005, Class: classNeutral},
+
+		// Moves of side variations are not ranked
+		{Path: "3.1/3", MoveNumber: 3, Variation: 1, Player: "black", Drop: 0.50, Class: classHotSpot},
+		{Path: "3.1/5", MoveNumber: 5, Variation: 1, Player: "black", Drop: -0.50, Class: classGood, TopChoice: true},
+	}
+	tests := []struct {
+		num         int
+		worst, best []string
+	}{
+		// The first choice that lost a little is only a worst move, and the
+		// neutral move is neither
+		{2, []string{"1", "3"}, []string{"5", "7"}},
+		// Moves that lost nothing are never worst moves
+		{5, []string{"1", "3", "9"}, []string{"5", "7"}},
+	}
+	for _, tt := range tests {
+		ranked := rankMoves(moves, tt.num, rankByWinrate)
+		if got := paths(ranked["black"].Worst); !reflect.DeepEqual(got, tt.worst) {
+			t.Errorf("%d worst moves = %v; want %v", tt.num, got, tt.worst)
+		}
+		if got := paths(ranked["black"].Best); !reflect.DeepEqual(got, tt.best) {
+			t.Errorf("%d best moves = %v; want %v", tt.num, got, tt.best)
+		}
+		if got := paths(ranked["white"].Worst); !reflect.DeepEqual(got, []string{"2"}) {
+			t.Errorf("%d worst moves of white = %v; want [2]", tt.num, got)
+		}
+		if got := ranked["white"].Best; len(got) != 0 {
+			t.Errorf("%d best moves of white = %v; want none", tt.num, paths(got))
+		}
+	}
+}
+
+func TestCountClasses(t *testing.T) {
+	moves := []MoveInfo{
+		{Path: "1", Player: "black", Class: classBad},
+		{Path: "2", Player: "white", Class: classGood},
+		{Path: "3", Player: "black", Class: classGood},
+		{Path: "5", Player: "black", Class: classGood},
+		{Path: "3.1/3", Variation: 1, Player: "black", Class: classHotSpot},
+		{Path: "3.1/4", Variation: 1, Player: "white", Class: classBad},
+	}
+	counts := countClasses(moves)
+	want := map[string]map[string]int{
+		"black": {classGood: 2, classBad: 1},
+		"white": {classGood: 1},
+	}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("countClasses = %v; want %v", counts, want)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// downloadTimeout is the time limit for downloading a game record
+	downloadTimeout = 30 * time.Second
+	// maxDownloadSize is the largest game record that will be downloaded
+	maxDownloadSize = 4 << 20
+	// maxFileNameLength is the longest file name used for a downloaded game
+	maxFileNameLength = 100
+)
+
+// isURL returns true if the argument is an http or https URL
+func isURL(arg string) bool {
+	lower := strings.ToLower(arg)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// downloadGame downloads a game record from an http(s) URL and saves it in
+// the given directory, under a file name that is derived from the URL and
+// has the extension of the detected format. The path of the saved file is
+// returned.
+func downloadGame(client *http.Client, rawURL, dir string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+
+	if client == nil {
+		client = &http.Client{Timeout: downloadTimeout}
+	}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("downloading %s: %s", rawURL, resp.Status)
+	}
+
+	// Read one byte more than the limit, to detect records that are too large
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxDownloadSize+1))
+	if err != nil {
+		return "", fmt.Errorf("downloading %s: %v", rawURL, err)
+	}
+	if len(data) > maxDownloadSize {
+		return "", fmt.Errorf("downloading %s: larger than %d bytes", rawURL, maxDownloadSize)
+	}
+
+	// Web pages are only accepted if they turn out to contain a game record
+	format := sniffFormat(data)
+	if format == "" {
+		format = formatFromContentType(resp.Header.Get("Content-Type"))
+	}
+	if format == "" {
+		format = detectFormat(u.Path, data)
+	}
+	if format == "" {
+		return "", fmt.Errorf("downloading %s: no game record found (content type %q)", rawURL, resp.Header.Get("Content-Type"))
+	}
+
+	filePath := filepath.Join(dir, downloadFileName(u, format))
+	if err := os.WriteFile(filePath, data, 0o644); err != nil {
+		return "", err
+	}
+	fmt.Printf("downloaded: %s\n", filePath)
+	return filePath, nil
+}
+
+// formatFromContentType returns the game record format for a content type,
+// or "" if the content type does not tell
+func formatFromContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	switch mediaType {
+	case "application/x-go-sgf", "application/sgf":
+		return formatSGF
+	}
+	return ""
+}
+
+// downloadFileName derives a file name from a URL, keeping only characters
+// that are safe in file names on all platforms
+func downloadFileName(u *url.URL, format string) string {
+	name := u.Host + "_" + strings.TrimSuffix(filepath.Base(u.Path), filepath.Ext(u.Path))
+	if u.RawQuery != "" {
+		name += "_" + u.RawQuery
+	}
+
+	// Runs of dots are collapsed, so that ".." never appears
+	var sb strings.Builder
+	var last rune
+	for _, r := range name {
+		switch {
+		case r == '.' && last == '.':
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+			sb.WriteRune(r)
+			last = r
+		case last != '_':
+			sb.WriteRune('_')
+			last = '_'
+		}
+	}
+
+	sanitized := strings.Trim(sb.String(), "._")
+	if len(sanitized) > maxFileNameLength {
+		sanitized = sanitized[:maxFileNameLength]
+	}
+	if sanitized == "" {
+		sanitized = "download"
+	}
+	return sanitized + "." + format
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testSGF = "(;GM[1]FF[4]SZ[19]KM[6.5];B[pd];W[dp])"
+
+func TestDownloadGame(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/games/game.sgf", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-go-sgf")
+		w.Write([]byte(testSGF))
+	})
+	mux.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
+		// A game record served without a telling content type or name
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte(testSGF))
+	})
+	mux.HandleFunc("/missing.sgf", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/huge.sgf", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testSGF))
+		w.Write([]byte(strings.Repeat(" ", maxDownloadSize)))
+	})
+	mux.HandleFunc("/page.html", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<!DOCTYPE html><html><body>Log in to download this game</body></html>"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tests := []struct {
+		path     string
+		wantErr  string
+		wantName string
+	}{
+		{path: "/games/game.sgf", wantName: "game.sgf"},
+		{path: "/download?id=42", wantName: "download_id_42.sgf"},
+		{path: "/missing.sgf", wantErr: "404"},
+		{path: "/huge.sgf", wantErr: "larger than"},
+		{path: "/page.html", wantErr: "no game record"},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		filePath, err := downloadGame(server.Client(), server.URL+tt.path, dir)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("downloading %s: got error %v, want %q", tt.path, err, tt.wantErr)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+				t.Errorf("downloading %s: %d files were saved after an error", tt.path, len(entries))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("downloading %s: %v", tt.path, err)
+			continue
+		}
+		if filepath.Dir(filePath) != dir || !strings.HasSuffix(filePath, tt.wantName) {
+			t.Errorf("downloading %s: saved as %s, want %s in %s", tt.path, filePath, tt.wantName, dir)
+		}
+		data, err := os.ReadFile(filePath)
+		if err != nil || string(data) != testSGF {
+			t.Errorf("downloading %s: saved %q, %v", tt.path, data, err)
+		}
+	}
+
+	if _, err := downloadGame(server.Client(), "ftp://example.com/game.sgf", t.TempDir()); err == nil {
+		t.Error("downloading an ftp URL did not fail")
+	}
+}
+
+func TestDownloadFileName(t *testing.T) {
+	tests := []struct {
+		rawURL string
+		want   string
+	}{
+		{"https://example.com/games/game.sgf", "example.com_game.sgf"},
+		{"https://example.com:8080/game.sgf", "example.com_8080_game.sgf"},
+		{"https://example.com/../../etc/passwd", "example.com_passwd.sgf"},
+		{"https://example.com/games/..", "example.com.sgf"},
+		{"https://example.com/games/..%2F..%2Fsecret.sgf", "example.com_secret.sgf"},
+		{"https://example.com/view?id=42&name=../../x", "example.com_view_id_42_name_._._x.sgf"},
+		{"https://example.com/game.sgf?a=b/c\\d", "example.com_game_a_b_c_d.sgf"},
+		{"https://example.com/" + strings.Repeat("a", 200), "example.com_" + strings.Repeat("a", maxFileNameLength-len("example.com_")) + ".sgf"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := downloadFileName(u, formatSGF)
+		if got != tt.want {
+			t.Errorf("downloadFileName(%q) = %q; want %q", tt.rawURL, got, tt.want)
+		}
+		if strings.Contains(got, "..") || strings.ContainsAny(got, `/\`) || filepath.Base(got) != got {
+			t.Errorf("downloadFileName(%q) = %q is not a plain file name", tt.rawURL, got)
+		}
+	}
+}
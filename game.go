@@ -0,0 +1,380 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/rooklift/sgf"
+	"github.com/xyproto/top3/coord"
+)
+
+// Line represents a line of play from the root of the game tree
+type Line struct {
+	InitialStones [][2]string
+	Moves         [][2]string
+	MoveNumbers   []int
+	Nodes         []*sgf.Node // the node of each move
+
+	// Paths holds the path of the position at each turn, starting with the
+	// root, so that turn N of a KataGo query on the line is Paths[N]
+	Paths []string
+	// Leaf is the path of the last node of the line, which identifies it
+	Leaf string
+}
+
+// Position represents a move node in the game tree, together with the moves
+// leading up to and including it
+type Position struct {
+	Node          *sgf.Node
+	Path          string
+	Before        string // the path of the position before the move
+	Variation     int
+	MoveNumber    int
+	InitialStones [][2]string
+	Moves         [][2]string
+}
+
+// GameSettings represents the rules, komi, board size and first player of a
+// game, as sent to KataGo
+type GameSettings struct {
+	Rules         string
+	Komi          float64
+	BoardXSize    int
+	BoardYSize    int
+	InitialPlayer string
+}
+
+// gameSettings reads the game settings from the SZ, KM, RU and PL properties
+// of the root node. The analysis options are used as fallbacks for properties
+// that are missing, while options given with -a override the SGF file.
+func gameSettings(root *sgf.Node, opts Options) GameSettings {
+	settings := GameSettings{
+		Rules:      opts.Analysis.Rules,
+		Komi:       opts.Analysis.Komi,
+		BoardXSize: opts.Analysis.BoardXSize,
+		BoardYSize: opts.Analysis.BoardYSize,
+	}
+	if settings.BoardXSize == 0 {
+		settings.BoardXSize = 19
+	}
+	if settings.BoardYSize == 0 {
+		settings.BoardYSize = settings.BoardXSize
+	}
+
+	overridden := func(key string) bool {
+		_, ok := opts.Analysis.Overrides[key]
+		return ok
+	}
+
+	if sz, ok := root.GetValue("SZ"); ok {
+		if x, y, err := parseBoardSize(sz); err != nil {
+			log.Printf("Ignoring SZ[%s]: %v", sz, err)
+		} else {
+			if !overridden("boardXSize") {
+				settings.BoardXSize = x
+			}
+			if !overridden("boardYSize") {
+				settings.BoardYSize = y
+			}
+		}
+	}
+
+	if km, ok := root.GetValue("KM"); ok && !overridden("komi") {
+		if komi, err := strconv.ParseFloat(strings.TrimSpace(km), 64); err != nil {
+			log.Printf("Ignoring KM[%s]: %v", km, err)
+		} else {
+			settings.Komi = komi
+		}
+	}
+
+	if ru, ok := root.GetValue("RU"); ok && strings.TrimSpace(ru) != "" && !overridden("rules") {
+		settings.Rules = strings.TrimSpace(ru)
+	}
+
+	if pl, ok := root.GetValue("PL"); ok {
+		switch strings.ToUpper(strings.TrimSpace(pl)) {
+		case "B", "BLACK":
+			settings.InitialPlayer = "black"
+		case "W", "WHITE":
+			settings.InitialPlayer = "white"
+		default:
+			log.Printf("Ignoring PL[%s]", pl)
+		}
+	} else if root.RootHandicap() > 1 {
+		// White moves first in handicap games
+		settings.InitialPlayer = "white"
+	}
+
+	return settings
+}
+
+// parseBoardSize parses the value of an SZ property, which is either a single
+// number or "columns:rows" for rectangular boards
+func parseBoardSize(sz string) (x, y int, err error) {
+	parts := strings.SplitN(sz, ":", 2)
+	x, err = strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, err
+	}
+	y = x
+	if len(parts) == 2 {
+		y, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if err := coord.CheckSize(x, y); err != nil {
+		return 0, 0, err
+	}
+	return x, y, nil
+}
+
+// addHandicapStones places the standard handicap stones on the root node when
+// the game has an HA property but no AB stones
+func addHandicapStones(root *sgf.Node, settings GameSettings) {
+	handicap := root.RootHandicap()
+	if handicap < 2 || root.ValueCount("AB") > 0 {
+		return
+	}
+	if settings.BoardXSize != settings.BoardYSize {
+		log.Printf("Can not place %d handicap stones on a %dx%d board", handicap, settings.BoardXSize, settings.BoardYSize)
+		return
+	}
+	root.SetValues("AB", sgf.HandicapPoints(settings.BoardXSize, handicap, false))
+}
+
+// extractMoves extracts initial stones and the moves of the main line from the
+// SGF file, together with the move number of each extracted move
+func extractMoves(node *sgf.Node, settings GameSettings) (initialStones [][2]string, moves [][2]string, moveNumbers []int) {
+	var nodes []*sgf.Node
+	for n := node; n != nil; n = n.MainChild() {
+		nodes = append(nodes, n)
+	}
+	line := extractLine(nodes, settings)
+	return line.InitialStones, line.Moves, line.MoveNumbers
+}
+
+// extractLine extracts initial stones, moves and move numbers from a line of
+// nodes, starting at the root. Setup stones placed before the first move are
+// treated as initial stones, while nodes with only comments or other
+// properties are skipped. The line ends before a move that can not be
+// converted, and before setup stones that follow a move.
+func extractLine(nodes []*sgf.Node, settings GameSettings) Line {
+	line := Line{
+		InitialStones: make([][2]string, 0),
+		Moves:         make([][2]string, 0),
+		MoveNumbers:   make([]int, 0),
+		Nodes:         make([]*sgf.Node, 0),
+		Paths:         make([]string, 0),
+	}
+	if len(nodes) > 0 {
+		line.Paths = append(line.Paths, nodePath(nodes[0]))
+		line.Leaf = nodePath(nodes[len(nodes)-1])
+	}
+
+	moveNumber := 0
+	for _, n := range nodes {
+		// Setup stones after the first move change the position in a way
+		// that KataGo can not be told about, so the line ends there
+		if len(line.Moves) > 0 {
+			for _, key := range []string{"AB", "AW", "AE"} {
+				if values := n.AllValues(key); len(values) > 0 {
+					log.Printf("Ending the line after move %d at %s[%s]: setup stones after the first move", moveNumber, key, values[0])
+					return line
+				}
+			}
+		}
+
+		for _, value := range n.AllValues("AE") {
+			points, err := setupPoints(value, settings)
+			if err != nil {
+				log.Printf("Ignoring AE[%s]: %v", value, err)
+				continue
+			}
+			for _, gtpCoord := range points {
+				line.InitialStones = removeStone(line.InitialStones, gtpCoord)
+			}
+		}
+		for _, key := range []string{"AB", "AW"} {
+			values := n.AllValues(key)
+			if len(values) == 0 {
+				continue
+			}
+			player := "black"
+			if key == "AW" {
+				player = "white"
+			}
+			for _, value := range values {
+				points, err := setupPoints(value, settings)
+				if err != nil {
+					log.Printf("Ignoring %s[%s]: %v", key, value, err)
+					continue
+				}
+				for _, gtpCoord := range points {
+					line.InitialStones = append(removeStone(line.InitialStones, gtpCoord), [2]string{player, gtpCoord})
+				}
+			}
+		}
+
+		for _, key := range []string{"B", "W"} {
+			if move, ok := n.GetValue(key); ok {
+				player := "black"
+				if key == "W" {
+					player = "white"
+				}
+				moveNumber++
+				// MN sets the move number of the node explicitly
+				if mn, ok := n.GetValue("MN"); ok {
+					if v, err := strconv.Atoi(mn); err == nil {
+						moveNumber = v
+					}
+				}
+				gtpCoord, err := coord.SGFToGTP(move, settings.BoardXSize, settings.BoardYSize)
+				if err != nil {
+					// Without the move, KataGo would be given the wrong
+					// position for every later move
+					log.Printf("Ending the line at move %d %s[%s]: %v", moveNumber, key, move, err)
+					return line
+				}
+				line.Moves = append(line.Moves, [2]string{player, gtpCoord})
+				line.MoveNumbers = append(line.MoveNumbers, moveNumber)
+				line.Nodes = append(line.Nodes, n)
+				line.Paths = append(line.Paths, nodePath(n))
+			}
+		}
+	}
+
+	return line
+}
+
+// setupPoints converts the value of an AB, AW or AE property to GTP
+// coordinates. The value is either a single point or a compressed rectangle
+// of points, such as "aa:cc".
+func setupPoints(value string, settings GameSettings) ([]string, error) {
+	corners := strings.Split(value, ":")
+	if len(corners) > 2 {
+		return nil, fmt.Errorf("invalid point list %q", value)
+	}
+	x1, y1, err := coord.SGFToXY(corners[0], settings.BoardXSize, settings.BoardYSize)
+	if err != nil {
+		return nil, err
+	}
+	x2, y2 := x1, y1
+	if len(corners) == 2 {
+		if x2, y2, err = coord.SGFToXY(corners[1], settings.BoardXSize, settings.BoardYSize); err != nil {
+			return nil, err
+		}
+	}
+	if x1 > x2 {
+		x1, x2 = x2, x1
+	}
+	if y1 > y2 {
+		y1, y2 = y2, y1
+	}
+	points := make([]string, 0)
+	for x := x1; x <= x2; x++ {
+		for y := y1; y <= y2; y++ {
+			gtpCoord, err := coord.XYToGTP(x, y, settings.BoardXSize, settings.BoardYSize)
+			if err != nil {
+				return nil, err
+			}
+			points = append(points, gtpCoord)
+		}
+	}
+	return points, nil
+}
+
+// extractLines extracts every line of play in the game tree, from the root to
+// each leaf. Line 0 is the main line, and the other lines are numbered in
+// tree order.
+func extractLines(root *sgf.Node, settings GameSettings) []Line {
+	leaves := leafNodes(root)
+	lines := make([]Line, 0, len(leaves))
+	for _, leaf := range leaves {
+		lines = append(lines, extractLine(leaf.GetLine(), settings))
+	}
+	return lines
+}
+
+// extractPositions extracts every move node of every line. The variation of a
+// position is the number of the line. A move that is shared by several lines
+// is only returned once, as part of the first line it appears in.
+func extractPositions(lines []Line) []Position {
+	positions := make([]Position, 0)
+	seen := make(map[*sgf.Node]bool)
+
+	for variation, line := range lines {
+		for i, node := range line.Nodes {
+			if seen[node] {
+				continue
+			}
+			seen[node] = true
+			positions = append(positions, Position{
+				Node:          node,
+				Path:          line.Paths[i+1],
+				Before:        line.Paths[i],
+				Variation:     variation,
+				MoveNumber:    line.MoveNumbers[i],
+				InitialStones: line.InitialStones,
+				Moves:         line.Moves[:i+1],
+			})
+		}
+	}
+
+	return positions
+}
+
+// leafNodes returns the last node of every variation in the game tree, with
+// the end of the main line first
+func leafNodes(root *sgf.Node) []*sgf.Node {
+	leaves := make([]*sgf.Node, 0)
+	for _, node := range root.SubtreeNodes() {
+		if node.MainChild() == nil {
+			leaves = append(leaves, node)
+		}
+	}
+	return leaves
+}
+
+// nodePath returns a string that identifies a node in the game tree. It
+// consists of the branch points that leave the main line, written as
+// "depth.child", followed by the depth of the node. For example, "137" is
+// the node at depth 137 of the main line, and "45.1/47" is the node at depth
+// 47 of the line that takes the second child at depth 45.
+func nodePath(node *sgf.Node) string {
+	parts := make([]string, 0)
+	depth := 0
+	for _, n := range node.GetLine()[1:] {
+		depth++
+		for i, sibling := range n.Parent().Children() {
+			if sibling == n {
+				if i > 0 {
+					parts = append(parts, fmt.Sprintf("%d.%d", depth, i))
+				}
+				break
+			}
+		}
+	}
+	return strings.Join(append(parts, strconv.Itoa(depth)), "/")
+}
+
+// variationName returns a human readable name for a variation number
+func variationName(variation int) string {
+	if variation == 0 {
+		return "main line"
+	}
+	return fmt.Sprintf("variation %d", variation)
+}
+
+// removeStone removes any stone at the given GTP coordinate
+func removeStone(stones [][2]string, gtpCoord string) [][2]string {
+	kept := make([][2]string, 0, len(stones))
+	for _, stone := range stones {
+		if stone[1] != gtpCoord {
+			kept = append(kept, stone)
+		}
+	}
+	return kept
+}
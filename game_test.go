@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rooklift/sgf"
+)
+
+// testTree has a main line of five moves, a branch at move 5 and a branch at
+// move 3 that has a move of its own after the branching move
+const testTree = "(;GM[1]FF[4]SZ[9];B[ee];W[cc](;B[gg];W[cg](;B[gc])(;B[gd]))(;B[cg];W[gg]))"
+
+func TestExtractLines(t *testing.T) {
+	root, err := sgf.LoadSGF(testTree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := GameSettings{BoardXSize: 9, BoardYSize: 9}
+	lines := extractLines(root, settings)
+
+	wantLines := []struct {
+		leaf  string
+		paths []string
+		moves []string
+	}{
+		{"5", []string{"0", "1", "2", "3", "4", "5"}, []string{"E5", "C7", "G3", "C3", "G7"}},
+		{"5.1/5", []string{"0", "1", "2", "3", "4", "5.1/5"}, []string{"E5", "C7", "G3", "C3", "G6"}},
+		{"3.1/4", []string{"0", "1", "2", "3.1/3", "3.1/4"}, []string{"E5", "C7", "C3", "G3"}},
+	}
+	if len(lines) != len(wantLines) {
+		t.Fatalf("got %d lines, want %d", len(lines), len(wantLines))
+	}
+	for i, want := range wantLines {
+		line := lines[i]
+		moves := make([]string, 0, len(line.Moves))
+		for _, move := range line.Moves {
+			moves = append(moves, move[1])
+		}
+		if line.Leaf != want.leaf || !reflect.DeepEqual(line.Paths, want.paths) || !reflect.DeepEqual(moves, want.moves) {
+			t.Errorf("line %d: leaf %q, paths %v, moves %v; want %q, %v, %v", i, line.Leaf, line.Paths, moves, want.leaf, want.paths, want.moves)
+		}
+	}
+
+	// Every node of the tree has its own path
+	seen := make(map[string]*sgf.Node)
+	for _, node := range root.SubtreeNodes() {
+		path := nodePath(node)
+		if other, ok := seen[path]; ok && other != node {
+			t.Errorf("two nodes have the path %q", path)
+		}
+		seen[path] = node
+	}
+}
+
+func TestExtractPositions(t *testing.T) {
+	root, err := sgf.LoadSGF(testTree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	positions := extractPositions(extractLines(root, GameSettings{BoardXSize: 9, BoardYSize: 9}))
+
+	// Moves shared by several lines are reported once, under the first line
+	wantPositions := []struct {
+		path, before string
+		variation    int
+		moveNumber   int
+	}{
+		{"1", "0", 0, 1},
+		{"2", "1", 0, 2},
+		{"3", "2", 0, 3},
+		{"4", "3", 0, 4},
+		{"5", "4", 0, 5},
+		{"5.1/5", "4", 1, 5},
+		{"3.1/3", "2", 2, 3},
+		{"3.1/4", "3.1/3", 2, 4},
+	}
+	if len(positions) != len(wantPositions) {
+		t.Fatalf("got %d positions, want %d", len(positions), len(wantPositions))
+	}
+	for i, want := range wantPositions {
+		pos := positions[i]
+		if pos.Path != want.path || pos.Before != want.before || pos.Variation != want.variation || pos.MoveNumber != want.moveNumber {
+			t.Errorf("position %d: path %q, before %q, variation %d, move %d; want %q, %q, %d, %d", i, pos.Path, pos.Before, pos.Variation, pos.MoveNumber, want.path, want.before, want.variation, want.moveNumber)
+		}
+		if nodePath(pos.Node) != pos.Path {
+			t.Errorf("position %d: node has path %q, want %q", i, nodePath(pos.Node), pos.Path)
+		}
+		if len(pos.Moves) != pos.MoveNumber {
+			t.Errorf("position %d: %d moves lead to move %d", i, len(pos.Moves), pos.MoveNumber)
+		}
+	}
+}
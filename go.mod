@@ -4,5 +4,6 @@ go 1.22.5
 
 require (
 	github.com/rooklift/sgf v0.0.0-20230511200928-fc09b7bd0bfe
+	golang.org/x/text v0.21.0
 	gopkg.in/yaml.v2 v2.4.0
 )
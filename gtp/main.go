@@ -5,26 +5,15 @@ import (
 	"log"
 
 	"github.com/rooklift/sgf"
+	"github.com/xyproto/top3/coord"
 )
 
 // convertToGTP converts an SGF coordinate to a GTP coordinate
-func convertToGTP(sgfCoord string) string {
-	if sgfCoord == "" {
-		return "pass"
-	}
-
-	colChar := sgfCoord[0]
-	rowChar := sgfCoord[1]
-
-	col := colChar - 'a'
-	row := 19 - (rowChar - 'a')
-
-	// Skip the 'I' column in GTP format
-	if col >= 8 {
-		col++
+func convertToGTP(sgfCoord string, size int) string {
+	gtpCoord, err := coord.SGFToGTP(sgfCoord, size, size)
+	if err != nil {
+		log.Fatalf("Error converting %q: %v", sgfCoord, err)
 	}
-
-	gtpCoord := fmt.Sprintf("%c%d", col+'A', row)
 	return gtpCoord
 }
 
@@ -43,7 +32,7 @@ func main() {
 func traverseAndConvert(node *sgf.Node) {
 	for _, key := range []string{"B", "W"} {
 		if move, ok := node.GetValue(key); ok {
-			gtpMove := convertToGTP(move)
+			gtpMove := convertToGTP(move, node.RootBoardSize())
 			fmt.Printf("Player: %s, Move: %s, GTP: %s\n", key, move, gtpMove)
 		}
 	}
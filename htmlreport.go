@@ -0,0 +1,308 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"os"
+	"strings"
+
+	"github.com/rooklift/sgf"
+	"github.com/xyproto/top3/coord"
+	"github.com/xyproto/top3/diagram"
+)
+
+// indexHTML is the template of the HTML report of a game
+//
+//go:embed index.html
+var indexHTML string
+
+var reportTemplate = template.Must(template.New("report").Parse(indexHTML))
+
+const (
+	// graphWidth and graphHeight are the size of the winrate graph, in
+	// pixels
+	graphWidth  = 640
+	graphHeight = 200
+	// minGraphScore is the smallest score lead that the graph has room for
+	minGraphScore = 10.0
+	// maxVariationStones is the number of moves of KataGo's variation that
+	// are shown in the report
+	maxVariationStones = 10
+)
+
+// htmlReport holds the data for the HTML report template
+type htmlReport struct {
+	Title   string
+	Result  string
+	Date    string
+	Graph   template.HTML
+	Players []htmlPlayer
+
+	// Warnings are the warnings that KataGo reported, with the move they
+	// were reported for
+	Warnings []string
+}
+
+// htmlPlayer holds the data about one player for the HTML report
+type htmlPlayer struct {
+	Color, Name, Rank           string
+	Good, Neutral, Bad, HotSpot int
+	Worst, Best                 []htmlMove
+}
+
+// htmlMove holds the data about a listed move for the HTML report
+type htmlMove struct {
+	MoveInfo
+	Variation   string
+	DropPercent float64
+	Choice      string
+	Diagram     template.HTML
+	PVDiagram   template.HTML
+}
+
+// htmlReportPath returns the path of the HTML report of a game, given the
+// base name of the game
+func htmlReportPath(base string, opts Options) string {
+	return base + opts.SGF.FileSuffix + ".html"
+}
+
+// saveHTMLReport writes a self-contained HTML report of a game, with the
+// players, the result, a graph of the winrate and score lead, and the worst
+// and best moves of each player with a diagram of each
+func saveHTMLReport(filePath string, review Review, ranked map[string]PlayerMoves) error {
+	root := review.Root
+	report := htmlReport{
+		Title: "Go Game Analysis",
+		Graph: winrateGraph(review),
+	}
+	if name, ok := root.GetValue("GN"); ok && name != "" {
+		report.Title = name
+	}
+	report.Result, _ = root.GetValue("RE")
+	report.Date, _ = root.GetValue("DT")
+
+	// The nodes and positions of the moves, by path
+	nodes := make(map[string]*sgf.Node)
+	befores := make(map[string]string)
+	for _, line := range review.Lines {
+		for i, node := range line.Nodes {
+			nodes[line.Paths[i+1]] = node
+			befores[line.Paths[i+1]] = line.Paths[i]
+		}
+	}
+
+	counts := countClasses(review.Evaluations)
+	for _, player := range players {
+		nameKey, rankKey := "PB", "BR"
+		if player == "white" {
+			nameKey, rankKey = "PW", "WR"
+		}
+		p := htmlPlayer{
+			Color:   strings.ToUpper(player[:1]) + player[1:],
+			Good:    counts[player][classGood],
+			Neutral: counts[player][classNeutral],
+			Bad:     counts[player][classBad],
+			HotSpot: counts[player][classHotSpot],
+		}
+		p.Name, _ = root.GetValue(nameKey)
+		p.Rank, _ = root.GetValue(rankKey)
+		for _, move := range ranked[player].Worst {
+			p.Worst = append(p.Worst, newHTMLMove(move, nodes[move.Path], review.Analysis.Responses[befores[move.Path]], review))
+		}
+		for _, move := range ranked[player].Best {
+			p.Best = append(p.Best, newHTMLMove(move, nodes[move.Path], review.Analysis.Responses[befores[move.Path]], review))
+		}
+		report.Players = append(report.Players, p)
+	}
+
+	for _, move := range review.Warned {
+		where := "Start of the game"
+		if move.MoveNumber > 0 {
+			where = fmt.Sprintf("Move %d (%s)", move.MoveNumber, variationName(move.Variation))
+		}
+		for _, warning := range move.Warnings {
+			report.Warnings = append(report.Warnings, where+": "+warning)
+		}
+	}
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := reportTemplate.Execute(file, report); err != nil {
+		return err
+	}
+	fmt.Printf("generated: %s\n", filePath)
+	return nil
+}
+
+// newHTMLMove prepares a listed move for the HTML report, with a diagram of
+// the position after it and one of KataGo's variation instead of it. The
+// played move is marked with a circle, and KataGo's first choice with the
+// letter A.
+func newHTMLMove(move MoveInfo, node *sgf.Node, before AnalysisResponse, review Review) htmlMove {
+	m := htmlMove{
+		MoveInfo:    move,
+		Variation:   variationName(move.Variation),
+		DropPercent: move.Drop * 100,
+	}
+	settings := review.Settings
+	var best MoveInfoExt
+	if candidates := sortedCandidates(before); len(candidates) > 0 {
+		best = candidates[0]
+		winrate, _ := candidateValues(before, best, move.Player, review.Analysis.Perspective)
+		m.Choice = fmt.Sprintf("%s (%.2f%%)", best.Move, winrate*100)
+	}
+	otherChoice := best.Move != "" && !strings.EqualFold(best.Move, move.Move)
+
+	board := boardDiagram(node, settings)
+	if board == nil {
+		return m
+	}
+	played, playedOK := diagramPoint(move.Move, settings)
+	if playedOK {
+		board.LastMove = &played
+	}
+	if p, ok := diagramPoint(best.Move, settings); ok && otherChoice {
+		board.Candidates = append(board.Candidates, diagram.Candidate{Point: p, Label: "A", Best: true})
+	}
+	after := review.Analysis.Responses[move.Path]
+	board.Ownership = ownershipForBlack(after, opponent(move.Player), review.Analysis.Perspective, settings)
+	m.Diagram = template.HTML(board.SVG())
+
+	// KataGo's variation, from the position before the move
+	if !otherChoice || len(best.PV) == 0 {
+		return m
+	}
+	pvBoard := boardDiagram(node.Parent(), settings)
+	if pvBoard == nil {
+		return m
+	}
+	color, next := diagram.Black, diagram.White
+	if move.Player == "white" {
+		color, next = next, color
+	}
+	for i, pvMove := range best.PV {
+		if i == maxVariationStones {
+			break
+		}
+		if p, ok := diagramPoint(pvMove, settings); ok {
+			pvBoard.Variation = append(pvBoard.Variation, diagram.Move{Point: p, Color: color})
+		}
+		color, next = next, color
+	}
+	if playedOK {
+		pvBoard.Marks = append(pvBoard.Marks, diagram.Mark{Point: played, Shape: diagram.Cross})
+	}
+	m.PVDiagram = template.HTML(pvBoard.SVG())
+	return m
+}
+
+// boardDiagram returns a diagram of the position at a node, or nil if there
+// is none. Only square boards are supported.
+func boardDiagram(node *sgf.Node, settings GameSettings) *diagram.Board {
+	if node == nil || settings.BoardXSize != settings.BoardYSize || node.RootBoardSize() != settings.BoardXSize {
+		return nil
+	}
+	board := diagram.FromSGF(node.Board())
+	board.Coordinates = true
+	return board
+}
+
+// diagramPoint converts a GTP or KataGo move to a point of a diagram. Passes
+// are not points.
+func diagramPoint(move string, settings GameSettings) (diagram.Point, bool) {
+	if move == "" || coord.IsGTPPass(move) {
+		return diagram.Point{}, false
+	}
+	x, y, err := coord.GTPToXY(move, settings.BoardXSize, settings.BoardYSize)
+	return diagram.Point{X: x, Y: y}, err == nil
+}
+
+// ownershipForBlack returns the ownership of a response for a diagram, from
+// -1 for White to 1 for Black, or nil if the response has no ownership.
+// toMove is the player to move in the position.
+func ownershipForBlack(response AnalysisResponse, toMove, perspective string, settings GameSettings) [][]float64 {
+	width, height := settings.BoardXSize, settings.BoardYSize
+	if len(response.Ownership) != width*height {
+		return nil
+	}
+	sign := 1.0
+	if reportedSide(response, toMove, perspective) == "white" {
+		sign = -1
+	}
+	// KataGo lists the ownership row by row, from the top
+	ownership := make([][]float64, width)
+	for x := range ownership {
+		ownership[x] = make([]float64, height)
+		for y := range ownership[x] {
+			ownership[x][y] = sign * response.Ownership[y*width+x]
+		}
+	}
+	return ownership
+}
+
+// winrateGraph draws the winrate and the score lead of Black along the main
+// line as an SVG image. The winrate is drawn in black from 0% at the bottom
+// to 100% at the top, and the score lead in blue, scaled to the largest
+// lead.
+func winrateGraph(review Review) template.HTML {
+	if len(review.Lines) == 0 {
+		return ""
+	}
+	line := review.Lines[0]
+
+	type graphPoint struct {
+		turn           int
+		winrate, score float64
+	}
+	points := make([]graphPoint, 0, len(line.Paths))
+	maxScore := minGraphScore
+	for turn, path := range line.Paths {
+		response, ok := review.Analysis.Responses[path]
+		if !ok {
+			continue
+		}
+		toMove := review.Settings.InitialPlayer
+		if turn > 0 {
+			toMove = opponent(line.Moves[turn-1][0])
+		} else if toMove == "" {
+			toMove = "black"
+		}
+		winrate, score := playerValues(response, "black", toMove, review.Analysis.Perspective)
+		points = append(points, graphPoint{turn, winrate, score})
+		if score > maxScore {
+			maxScore = score
+		} else if -score > maxScore {
+			maxScore = -score
+		}
+	}
+	if len(points) == 0 {
+		return ""
+	}
+
+	turns := max(len(line.Paths)-1, 1)
+	x := func(turn int) float64 { return float64(turn) * graphWidth / float64(turns) }
+	var winrates, scores strings.Builder
+	for i, p := range points {
+		command := "L"
+		if i == 0 || points[i-1].turn != p.turn-1 {
+			command = "M"
+		}
+		fmt.Fprintf(&winrates, "%s%.1f %.1f", command, x(p.turn), (1-p.winrate)*graphHeight)
+		fmt.Fprintf(&scores, "%s%.1f %.1f", command, x(p.turn), (0.5-p.score/maxScore/2)*graphHeight)
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`, graphWidth, graphHeight, graphWidth, graphHeight)
+	fmt.Fprintf(&sb, `<rect width="%d" height="%d" fill="#f8f8f8" stroke="#ccc"/>`, graphWidth, graphHeight)
+	fmt.Fprintf(&sb, `<line x1="0" y1="%d" x2="%d" y2="%d" stroke="#ccc"/>`, graphHeight/2, graphWidth, graphHeight/2)
+	fmt.Fprintf(&sb, `<path d="%s" fill="none" stroke="#36c" stroke-width="1.5"/>`, scores.String())
+	fmt.Fprintf(&sb, `<path d="%s" fill="none" stroke="#000" stroke-width="1.5"/>`, winrates.String())
+	fmt.Fprintf(&sb, `<text x="4" y="14" font-size="12" font-family="sans-serif">100%% / +%.0f</text>`, maxScore)
+	fmt.Fprintf(&sb, `<text x="4" y="%d" font-size="12" font-family="sans-serif">0%% / -%.0f</text>`, graphHeight-4, maxScore)
+	sb.WriteString("</svg>")
+	return template.HTML(sb.String())
+}
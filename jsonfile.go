@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rooklift/sgf"
+)
+
+// queryIDPrefix is the prefix of the IDs of the queries sent to KataGo. It is
+// followed by the path of the leaf of the analyzed line, the first analyzed
+// turn and a sequence number, as in "analysis_45.1/60@0#12".
+const queryIDPrefix = "analysis_"
+
+// gameIndexPattern finds the game index that is added to the output files of
+// games in a collection
+var gameIndexPattern = regexp.MustCompile(`^(.*)-(\d+)$`)
+
+// Analysis holds the KataGo responses for the positions of a game, keyed by
+// the path of the position
+type Analysis struct {
+	Responses map[string]AnalysisResponse
+
+	// FirstPass holds the first responses for the positions that were
+	// analyzed again with -r
+	FirstPass map[string]AnalysisResponse
+
+	// Skipped holds the reason that KataGo gave no results for a position,
+	// such as an illegal move leading to it
+	Skipped map[string]string
+
+	// Warnings holds the warnings that KataGo reported for the queries,
+	// keyed by the first move that each query analyzed
+	Warnings map[string][]string
+
+	// Perspective is the reportAnalysisWinratesAs setting of KataGo when the
+	// responses were made
+	Perspective string
+
+	// raw holds responses from raw KataGo output, which are keyed once the
+	// lines of the game are known
+	raw []AnalysisResponse
+}
+
+// newAnalysis returns an empty analysis
+func newAnalysis() *Analysis {
+	return &Analysis{
+		Responses: make(map[string]AnalysisResponse),
+		FirstPass: make(map[string]AnalysisResponse),
+		Skipped:   make(map[string]string),
+		Warnings:  make(map[string][]string),
+	}
+}
+
+// skipReason returns the reason a move cannot be evaluated, which is that
+// KataGo has no results for the position after it, or "" if it can be
+// evaluated
+func (a *Analysis) skipReason(pos Position) string {
+	return a.Skipped[pos.Path]
+}
+
+// addWarning adds a warning for a position, unless it already has it
+func (a *Analysis) addWarning(path, warning string) {
+	for _, w := range a.Warnings[path] {
+		if w == warning {
+			return
+		}
+	}
+	a.Warnings[path] = append(a.Warnings[path], warning)
+}
+
+// SavedAnalysis represents the analysis of a game as saved with -s. It holds
+// everything that is needed to build the reports again with -f, without
+// running KataGo.
+type SavedAnalysis struct {
+	SGF           string                      `json:"sgf"`
+	InitialStones [][2]string                 `json:"initialStones"`
+	Moves         [][2]string                 `json:"moves"`
+	Evaluations   map[string]MoveInfo         `json:"evaluations"`
+	Responses     map[string]AnalysisResponse `json:"responses"`
+	FirstPass     map[string]AnalysisResponse `json:"firstPass,omitempty"`
+	Skipped       map[string]string           `json:"skipped,omitempty"`
+	Warnings      map[string][]string         `json:"warnings,omitempty"`
+	Perspective   string                      `json:"reportAnalysisWinratesAs,omitempty"`
+}
+
+// saveAnalysisAsJSON saves the game, the evaluations and the KataGo responses
+// as a JSON file. Positions that were analyzed again with -r have both the
+// first and the deeper response.
+func saveAnalysisAsJSON(jsonPath string, node *sgf.Node, initialStones [][2]string, moves [][2]string, moveEvaluations []MoveInfo, analysis *Analysis) error {
+	// Evaluations are keyed by the path of the move node in the game tree
+	evaluations := make(map[string]MoveInfo, len(moveEvaluations))
+	for _, moveInfo := range moveEvaluations {
+		evaluations[moveInfo.Path] = moveInfo
+	}
+
+	saved := SavedAnalysis{
+		SGF:           node.SGF(),
+		InitialStones: initialStones,
+		Moves:         moves,
+		Evaluations:   evaluations,
+		Responses:     analysis.Responses,
+		FirstPass:     analysis.FirstPass,
+		Skipped:       analysis.Skipped,
+		Warnings:      analysis.Warnings,
+		Perspective:   analysis.Perspective,
+	}
+
+	file, err := os.Create(jsonPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(saved); err != nil {
+		return fmt.Errorf("writing %s: %v", jsonPath, err)
+	}
+
+	fmt.Printf("generated: %s\n", file.Name())
+	return nil
+}
+
+// loadAnalysisJSON loads a game and its KataGo responses from a JSON file.
+// The file is either written by -s, or raw KataGo output with one response
+// per line, in which case the game is loaded from the game record with the
+// same name.
+func loadAnalysisJSON(jsonPath string) (*sgf.Node, *Analysis, error) {
+	data, err := os.ReadFile(jsonPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	analysis := newAnalysis()
+
+	var saved SavedAnalysis
+	if err := json.Unmarshal(data, &saved); err == nil && saved.SGF != "" {
+		node, err := sgf.LoadSGF(saved.SGF)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", jsonPath, err)
+		}
+		for key, response := range saved.Responses {
+			analysis.Responses[key] = response
+		}
+		for key, response := range saved.FirstPass {
+			analysis.FirstPass[key] = response
+		}
+		for key, reason := range saved.Skipped {
+			analysis.Skipped[key] = reason
+		}
+		for key, warnings := range saved.Warnings {
+			analysis.Warnings[key] = warnings
+		}
+		analysis.Perspective = saved.Perspective
+		return node, analysis, nil
+	}
+
+	node, err := loadGameForJSON(jsonPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	analysis.raw, err = parseRawResponses(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", jsonPath, err)
+	}
+	return node, analysis, nil
+}
+
+// loadGameForJSON finds and loads the game record that belongs to a JSON
+// file with raw KataGo output. For "name-2.json", the second game of a
+// collection in "name.sgf" is also considered.
+func loadGameForJSON(jsonPath string) (*sgf.Node, error) {
+	base := strings.TrimSuffix(jsonPath, filepath.Ext(jsonPath))
+	type candidate struct {
+		base  string
+		index int
+	}
+	candidates := []candidate{{base, 0}}
+	if m := gameIndexPattern.FindStringSubmatch(base); m != nil {
+		index, _ := strconv.Atoi(m[2])
+		candidates = append(candidates, candidate{m[1], index - 1})
+	}
+
+	for _, c := range candidates {
+		for _, ext := range []string{".sgf", ".gib", ".ngf"} {
+			filePath := c.base + ext
+			if _, err := os.Stat(filePath); err != nil {
+				continue
+			}
+			games, err := LoadGames(filePath)
+			if err != nil {
+				return nil, err
+			}
+			if c.index < 0 || c.index >= len(games) {
+				continue
+			}
+			return games[c.index], nil
+		}
+	}
+	return nil, fmt.Errorf("%s: no game record found for the KataGo output", jsonPath)
+}
+
+// parseRawResponses parses raw KataGo output, with one response per line
+func parseRawResponses(data []byte) ([]AnalysisResponse, error) {
+	responses := make([]AnalysisResponse, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var message kataGoMessage
+		var response AnalysisResponse
+		if json.Unmarshal(line, &message) != nil || json.Unmarshal(line, &response) != nil || response.ID == "" {
+			log.Printf("Ignoring KataGo output: %.80s", line)
+			continue
+		}
+		if message.Error != "" || message.Warning != "" || message.Action != "" || response.IsDuringSearch {
+			// Errors, warnings and replies to actions have no results
+			continue
+		}
+		responses = append(responses, response)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(responses) == 0 {
+		return nil, fmt.Errorf("no KataGo responses found")
+	}
+	return responses, nil
+}
+
+// resolveRaw keys the responses from raw KataGo output by the path of their
+// position. Responses to queries sent by this program find their line by the
+// leaf path in their ID, while other responses are assumed to be for the main
+// line. Either way, the turn number gives the position in the line.
+func (a *Analysis) resolveRaw(lines []Line) {
+	if len(a.raw) == 0 || len(lines) == 0 {
+		return
+	}
+	byLeaf := make(map[string]Line, len(lines))
+	for _, line := range lines {
+		byLeaf[line.Leaf] = line
+	}
+	for _, response := range a.raw {
+		line := lines[0]
+		if strings.HasPrefix(response.ID, queryIDPrefix) {
+			leaf, _, _ := strings.Cut(strings.TrimPrefix(response.ID, queryIDPrefix), "@")
+			var ok bool
+			if line, ok = byLeaf[leaf]; !ok {
+				log.Printf("Ignoring KataGo response %s: no such line", response.ID)
+				continue
+			}
+		}
+		if response.TurnNumber < 0 || response.TurnNumber >= len(line.Paths) {
+			continue
+		}
+		if err := response.Err(); err != nil {
+			a.Skipped[line.Paths[response.TurnNumber]] = err.Reason
+		} else {
+			a.Responses[line.Paths[response.TurnNumber]] = response
+		}
+	}
+	a.raw = nil
+}
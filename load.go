@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rooklift/sgf"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/transform"
+)
+
+// Game record formats
+const (
+	formatSGF = "sgf"
+	formatGIB = "gib" // Tygem and Cyberoro
+	formatNGF = "ngf" // WBaduk
+)
+
+var (
+	// sgfCharsetPattern finds the CA property of an SGF root node
+	sgfCharsetPattern = regexp.MustCompile(`CA\s*\[([^\]]*)\]`)
+
+	// nameRankPattern splits GIB player names like "name (9D)" into the name
+	// and the rank
+	nameRankPattern = regexp.MustCompile(`^(.*?)\s*\(([^()]*)\)$`)
+)
+
+// LoadGames loads a game record in the SGF, GIB or NGF format and returns the
+// root node of every game in it. SGF files may hold a collection of games,
+// while GIB and NGF files always hold a single game.
+func LoadGames(filePath string) ([]*sgf.Node, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return parseGames(filePath, data)
+}
+
+// parseGames parses the contents of a game record. The format is detected
+// from the contents, with the file extension used when the contents are
+// inconclusive.
+func parseGames(filePath string, data []byte) ([]*sgf.Node, error) {
+	format := detectFormat(filePath, data)
+	if format == "" {
+		return nil, fmt.Errorf("%s: unknown game record format", filePath)
+	}
+
+	text, err := decodeText(format, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filePath, err)
+	}
+
+	var roots []*sgf.Node
+	switch format {
+	case formatGIB:
+		var root *sgf.Node
+		root, err = sgf.LoadGIB(text)
+		if err == nil {
+			addGIBInfo(root, text)
+			roots = []*sgf.Node{root}
+		}
+	case formatNGF:
+		var root *sgf.Node
+		root, err = sgf.LoadNGF(text)
+		if err == nil {
+			roots = []*sgf.Node{root}
+		}
+	default:
+		roots, err = sgf.LoadCollectionSGF(text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filePath, err)
+	}
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("%s: no games found", filePath)
+	}
+
+	// The text has been decoded, so the games are now in UTF-8
+	for _, root := range roots {
+		root.SetValue("CA", "UTF-8")
+	}
+	return roots, nil
+}
+
+// detectFormat returns the format of a game record, or "" if unknown
+func detectFormat(filePath string, data []byte) string {
+	if format := sniffFormat(data); format != "" {
+		return format
+	}
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".sgf":
+		return formatSGF
+	case ".gib":
+		return formatGIB
+	case ".ngf":
+		return formatNGF
+	}
+	return ""
+}
+
+// sniffFormat detects the format of a game record from its contents
+func sniffFormat(data []byte) string {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+
+	if bytes.HasPrefix(trimmed, []byte("(")) && bytes.HasPrefix(bytes.TrimLeft(trimmed[1:], " \t\r\n"), []byte(";")) {
+		return formatSGF
+	}
+	if bytes.Contains(data, []byte(`\[GIBOKIND=`)) || bytes.Contains(data, []byte(`\HS`)) || bytes.Contains(data, []byte(`\[GAMEBLACKNAME=`)) {
+		return formatGIB
+	}
+
+	// NGF files start with a fixed header, where the second line is the
+	// board size, followed by moves starting with "PM"
+	lines := strings.Split(string(trimmed), "\n")
+	if len(lines) >= 12 {
+		if _, err := strconv.Atoi(strings.TrimSpace(lines[1])); err == nil {
+			for _, line := range lines[11:] {
+				if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(line)), "PM") {
+					return formatNGF
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// decodeText converts a game record to UTF-8. SGF files declare their
+// encoding with the CA property. GIB and NGF files have no such property, and
+// are usually encoded in CP949 (EUC-KR) unless they are valid UTF-8.
+func decodeText(format string, data []byte) (string, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+
+	if format == formatSGF {
+		if m := sgfCharsetPattern.FindSubmatch(data); m != nil {
+			charset := strings.TrimSpace(string(m[1]))
+			if enc, err := htmlindex.Get(charset); err == nil {
+				if name, _ := htmlindex.Name(enc); name != "utf-8" {
+					return decodeWith(transform.NewReader(bytes.NewReader(data), enc.NewDecoder()))
+				}
+			}
+		}
+	}
+
+	if utf8.Valid(data) {
+		return string(data), nil
+	}
+	return decodeWith(transform.NewReader(bytes.NewReader(data), korean.EUCKR.NewDecoder()))
+}
+
+// decodeWith reads all text from a decoding reader
+func decodeWith(r io.Reader) (string, error) {
+	decoded, err := io.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("decoding text: %v", err)
+	}
+	return string(decoded), nil
+}
+
+// addGIBInfo adds the game information that sgf.LoadGIB does not handle,
+// such as player ranks and the name of the game, to the root node
+func addGIBInfo(root *sgf.Node, gib string) {
+	for _, line := range strings.Split(gib, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, `\[`) || !strings.HasSuffix(line, `\]`) {
+			continue
+		}
+		key, value, ok := strings.Cut(line[2:len(line)-2], "=")
+		if !ok || strings.TrimSpace(value) == "" {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "GAMEBLACKNAME":
+			splitNameRank(root, value, "PB", "BR")
+		case "GAMEWHITENAME":
+			splitNameRank(root, value, "PW", "WR")
+		case "GAMENAME":
+			root.SetValue("GN", value)
+		case "GAMEPLACE":
+			root.SetValue("PC", value)
+		}
+	}
+}
+
+// splitNameRank sets the player name and rank properties from a GIB player
+// name like "name (9D)"
+func splitNameRank(root *sgf.Node, value, nameKey, rankKey string) {
+	m := nameRankPattern.FindStringSubmatch(value)
+	if m == nil || m[1] == "" {
+		root.SetValue(nameKey, value)
+		return
+	}
+	root.SetValue(nameKey, m[1])
+	root.SetValue(rankKey, m[2])
+}
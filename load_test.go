@@ -0,0 +1,171 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/korean"
+)
+
+// eucKR encodes text in EUC-KR, as Korean servers write game records
+func eucKR(t *testing.T, text string) []byte {
+	t.Helper()
+	encoded, err := korean.EUCKR.NewEncoder().String(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []byte(encoded)
+}
+
+const (
+	testGIB = "\\HS\r\n" +
+		"\\[GAMEBLACKNAME=이세돌 (9D)\\]\r\n" +
+		"\\[GAMEWHITENAME=박정환 (9D)\\]\r\n" +
+		"\\[GAMENAME=명인전\\]\r\n" +
+		"\\[GAMETAG=S0,R1,D0,G65,W1,Z0,T30-3-1200,C2016:03:09:10:00,I:lee,L:park,M:,N:\\]\r\n" +
+		"\\HE\r\n" +
+		"\\GS\r\n" +
+		"2 1 0\r\n" +
+		"INI 0 1 0 &4\r\n" +
+		"STO 0 2 1 15 3 \r\n" +
+		"STO 0 3 2 3 15 \r\n" +
+		"\\GE\r\n"
+
+	testNGF = "Game\n" +
+		"19\n" +
+		"white 9D\n" +
+		"black 9D\n" +
+		"www.wbaduk.com\n" +
+		"0\n" +
+		"0\n" +
+		"6\n" +
+		"20160309 [10:00]\n" +
+		"5\n" +
+		"white win by resign\n" +
+		"2\n" +
+		"PMABBEEEE\n" +
+		"PMACWQQQQ\n"
+)
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		filePath string
+		data     string
+		want     string
+	}{
+		{"sgf", "game.sgf", testSGF, formatSGF},
+		{"sgf without extension", "game", testSGF, formatSGF},
+		{"sgf with a byte order mark and spaces", "game.txt", "\xef\xbb\xbf \r\n( ;GM[1];B[aa])", formatSGF},
+		{"gib", "game.gib", testGIB, formatGIB},
+		{"gib without extension", "game", testGIB, formatGIB},
+		{"gib with an sgf extension", "game.sgf", testGIB, formatGIB},
+		{"gib in EUC-KR", "game", string(eucKR(t, testGIB)), formatGIB},
+		{"ngf", "game.ngf", testNGF, formatNGF},
+		{"ngf without extension", "game", testNGF, formatNGF},
+		{"unknown contents with extension", "game.ngf", "nothing", formatNGF},
+		{"unknown", "game.txt", "nothing to see here", ""},
+		{"html", "game", "<!DOCTYPE html><html></html>", ""},
+	}
+	for _, tt := range tests {
+		if got := detectFormat(tt.filePath, []byte(tt.data)); got != tt.want {
+			t.Errorf("%s: detectFormat = %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeText(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		data   []byte
+		want   string
+	}{
+		{"utf-8 sgf", formatSGF, []byte("(;CA[UTF-8]PB[이세돌])"), "(;CA[UTF-8]PB[이세돌])"},
+		{"euc-kr sgf", formatSGF, eucKR(t, "(;CA[EUC-KR]PB[이세돌])"), "(;CA[EUC-KR]PB[이세돌])"},
+		{"euc-kr sgf with lowercase charset", formatSGF, eucKR(t, "(;CA[euc-kr]PB[이세돌])"), "(;CA[euc-kr]PB[이세돌])"},
+		{"utf-8 gib", formatGIB, []byte("\\[GAMEBLACKNAME=이세돌\\]"), "\\[GAMEBLACKNAME=이세돌\\]"},
+		{"euc-kr gib", formatGIB, eucKR(t, "\\[GAMEBLACKNAME=이세돌\\]"), "\\[GAMEBLACKNAME=이세돌\\]"},
+		{"utf-8 with a byte order mark", formatSGF, []byte("\xef\xbb\xbf(;PB[a])"), "(;PB[a])"},
+	}
+	for _, tt := range tests {
+		got, err := decodeText(tt.format, tt.data)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: decodeText = %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseGames(t *testing.T) {
+	tests := []struct {
+		name     string
+		filePath string
+		data     []byte
+		want     map[string]string
+		moves    int
+	}{
+		{
+			name:     "gib in EUC-KR without extension",
+			filePath: "game",
+			data:     eucKR(t, testGIB),
+			want:     map[string]string{"PB": "이세돌", "BR": "9D", "PW": "박정환", "WR": "9D", "GN": "명인전", "KM": "6.5", "RE": "W+", "CA": "UTF-8"},
+			moves:    2,
+		},
+		{
+			name:     "gib in UTF-8",
+			filePath: "game.gib",
+			data:     []byte(strings.Replace(testGIB, "박정환 (9D)", "박정환", 1)),
+			want:     map[string]string{"PB": "이세돌", "BR": "9D", "PW": "박정환", "WR": ""},
+			moves:    2,
+		},
+		{
+			name:     "sgf in EUC-KR",
+			filePath: "game.sgf",
+			data:     eucKR(t, "(;GM[1]FF[4]CA[EUC-KR]SZ[19]PB[이세돌]PW[박정환];B[pd];W[dp];B[pp])"),
+			want:     map[string]string{"PB": "이세돌", "PW": "박정환", "CA": "UTF-8"},
+			moves:    3,
+		},
+		{
+			name:     "ngf",
+			filePath: "game",
+			data:     []byte(testNGF),
+			want:     map[string]string{"PB": "black", "PW": "white", "DT": "2016-03-09", "RE": "W+R"},
+			moves:    2,
+		},
+	}
+	for _, tt := range tests {
+		roots, err := parseGames(tt.filePath, tt.data)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(roots) != 1 {
+			t.Errorf("%s: got %d games, want 1", tt.name, len(roots))
+			continue
+		}
+		root := roots[0]
+		for key, want := range tt.want {
+			if got, _ := root.GetValue(key); got != want {
+				t.Errorf("%s: %s is %q; want %q", tt.name, key, got, want)
+			}
+		}
+		moves := 0
+		for node := root.MainChild(); node != nil; node = node.MainChild() {
+			moves++
+		}
+		if moves != tt.moves {
+			t.Errorf("%s: got %d moves, want %d", tt.name, moves, tt.moves)
+		}
+	}
+
+	if _, err := parseGames("game.txt", []byte("nothing to see here")); err == nil {
+		t.Error("parsing an unknown format did not fail")
+	}
+}
+
+func TestSGFCollection(t *testing.T) {
+	roots, err := parseGames("games.sgf", []byte(testSGF+"\n"+testSGF))
+	if err != nil || len(roots) != 2 {
+		t.Errorf("got %d games, %v; want 2", len(roots), err)
+	}
+}
@@ -1,28 +1,58 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 
 	"github.com/rooklift/sgf"
+	"github.com/xyproto/top3/coord"
 	"gopkg.in/yaml.v2"
 )
 
 // MoveInfo represents information about a move
 type MoveInfo struct {
-	Player  string
-	Move    string
-	Winrate float64
-	Drop    float64
+	Path       string
+	Variation  int
+	MoveNumber int
+	Player     string
+	Move       string
+	Winrate    float64 // the winrate of the player after the move
+	Drop       float64 // the winrate lost by the move
+	ScoreLead  float64 // the score lead of the player after the move
+	ScoreDrop  float64 // the points lost by the move
+
+	// TopChoice is true if the move was KataGo's first choice, in which case
+	// Margin and MarginPoints tell how much better it was than the second
+	// choice, which shows how critical the position was
+	TopChoice    bool
+	Margin       float64
+	MarginPoints float64
+
+	// Class is the classification of the move: good, neutral, bad or hotspot
+	Class string
+
+	// Revisited is true if the move was analyzed again with -r, in which
+	// case FirstPassDrop and FirstPassScoreDrop are the losses found by the
+	// first pass
+	Revisited          bool
+	FirstPassDrop      float64
+	FirstPassScoreDrop float64
+
+	// Skipped is the reason the move could not be evaluated, if any
+	Skipped string
+
+	// Warnings are the warnings that KataGo reported for the query that
+	// analyzed the move
+	Warnings []string `json:",omitempty"`
 }
 
 // AnalysisRequest represents the request structure for KataGo
@@ -30,23 +60,76 @@ type AnalysisRequest struct {
 	ID            string      `json:"id"`
 	InitialStones [][2]string `json:"initialStones,omitempty"`
 	Moves         [][2]string `json:"moves"`
-	Rules         string      `json:"rules"`
+	Rules         KataGoRules `json:"rules"`
 	Komi          float64     `json:"komi"`
 	BoardXSize    int         `json:"boardXSize"`
 	BoardYSize    int         `json:"boardYSize"`
+	InitialPlayer string      `json:"initialPlayer,omitempty"`
 	AnalyzeTurns  []int       `json:"analyzeTurns"`
+
+	// Search settings, which are left to the KataGo config when not set
+	MaxVisits             int                    `json:"maxVisits,omitempty"`
+	RootPolicyTemperature float64                `json:"rootPolicyTemperature,omitempty"`
+	IncludeOwnership      bool                   `json:"includeOwnership,omitempty"`
+	IncludePolicy         bool                   `json:"includePolicy,omitempty"`
+	IncludePVVisits       bool                   `json:"includePVVisits,omitempty"`
+	AvoidMoves            []MoveRestriction      `json:"avoidMoves,omitempty"`
+	AllowMoves            []MoveRestriction      `json:"allowMoves,omitempty"`
+	OverrideSettings      map[string]interface{} `json:"overrideSettings,omitempty"`
+}
+
+// MoveRestriction represents an entry of avoidMoves or allowMoves in a KataGo
+// query, which restricts the moves that the search considers for a player
+type MoveRestriction struct {
+	Player     string   `yaml:"player" json:"player"`
+	Moves      []string `yaml:"moves" json:"moves"`
+	UntilDepth int      `yaml:"untilDepth" json:"untilDepth"`
 }
 
-// AnalysisResponse represents the response structure from KataGo
+// AnalysisResponse represents the response structure from KataGo. The
+// ownership and policy arrays are only sent when requested, and hold one
+// value for every point of the board, row by row from the top left.
 type AnalysisResponse struct {
-	ID        string        `json:"id"`
-	MoveInfos []MoveInfoExt `json:"moveInfos"`
+	ID             string        `json:"id"`
+	TurnNumber     int           `json:"turnNumber"`
+	IsDuringSearch bool          `json:"isDuringSearch,omitempty"`
+	NoResults      bool          `json:"noResults,omitempty"`
+	MoveInfos      []MoveInfoExt `json:"moveInfos"`
+	RootInfo       RootInfo      `json:"rootInfo"`
+	Ownership      []float64     `json:"ownership,omitempty"`
+	OwnershipStdev []float64     `json:"ownershipStdev,omitempty"`
+	Policy         []float64     `json:"policy,omitempty"` // with one more value for passing
+	HumanPolicy    []float64     `json:"humanPolicy,omitempty"`
+}
+
+// RootInfo represents KataGo's evaluation of the analyzed position itself
+type RootInfo struct {
+	Winrate       float64 `json:"winrate"`
+	ScoreLead     float64 `json:"scoreLead"`
+	ScoreStdev    float64 `json:"scoreStdev"`
+	Utility       float64 `json:"utility"`
+	Visits        int     `json:"visits"`
+	CurrentPlayer string  `json:"currentPlayer,omitempty"`
 }
 
-// MoveInfoExt extends MoveInfo with extra information
+// MoveInfoExt represents a candidate move of a KataGo response. Order is the
+// rank of the move, 0 being the best. PV is the principal variation starting
+// with the move, and PVVisits is only sent when includePVVisits is set.
 type MoveInfoExt struct {
-	Move    string  `json:"move"`
-	Winrate float64 `json:"winrate"`
+	Move         string   `json:"move"`
+	Visits       int      `json:"visits"`
+	Order        int      `json:"order"`
+	Winrate      float64  `json:"winrate"`
+	ScoreMean    float64  `json:"scoreMean"`
+	ScoreLead    float64  `json:"scoreLead"`
+	ScoreStdev   float64  `json:"scoreStdev"`
+	Prior        float64  `json:"prior"`
+	Utility      float64  `json:"utility"`
+	LCB          float64  `json:"lcb"`
+	UtilityLCB   float64  `json:"utilityLcb"`
+	PV           []string `json:"pv,omitempty"`
+	PVVisits     []int    `json:"pvVisits,omitempty"`
+	IsSymmetryOf string   `json:"isSymmetryOf,omitempty"`
 }
 
 // Options represents configuration options
@@ -56,6 +139,7 @@ type Options struct {
 		Arguments string `yaml:"arguments"`
 		Model     string `yaml:"model"`
 		Config    string `yaml:"config"`
+		Engines   int    `yaml:"engines"`
 	} `yaml:"katago"`
 	Analysis struct {
 		Rules      string  `yaml:"rules"`
@@ -63,6 +147,21 @@ type Options struct {
 		BoardXSize int     `yaml:"boardXSize"`
 		BoardYSize int     `yaml:"boardYSize"`
 		MaxVisits  int     `yaml:"maxVisits"`
+
+		// AnalyzeTurns limits the analysis to these turns of each line
+		AnalyzeTurns []int `yaml:"analyzeTurns"`
+
+		RootPolicyTemperature float64                `yaml:"rootPolicyTemperature"`
+		IncludeOwnership      bool                   `yaml:"includeOwnership"`
+		IncludePolicy         bool                   `yaml:"includePolicy"`
+		IncludePVVisits       bool                   `yaml:"includePVVisits"`
+		AvoidMoves            []MoveRestriction      `yaml:"avoidMoves"`
+		AllowMoves            []MoveRestriction      `yaml:"allowMoves"`
+		OverrideSettings      map[string]interface{} `yaml:"overrideSettings"`
+
+		// Overrides holds the options given with -a, which take precedence
+		// over the game settings found in the SGF file
+		Overrides map[string]string `yaml:"-"`
 	} `yaml:"analysis"`
 	SGF struct {
 		MaxWinRateDropForGoodMove   float64 `yaml:"maxWinrateDropForGoodMove"`
@@ -73,6 +172,17 @@ type Options struct {
 		ShowBadVariations           bool    `yaml:"showBadVariations"`
 		MaxVariationsForEachMove    int     `yaml:"maxVariationsForEachMove"`
 		FileSuffix                  string  `yaml:"fileSuffix"`
+
+		// RankBy selects how moves are ranked: by "winrate" drop, by
+		// "points" lost, or "blended", which adds the two
+		RankBy string `yaml:"rankBy"`
+		// TopMovesPerPlayer is the number of worst and best moves that are
+		// reported for each player
+		TopMovesPerPlayer int `yaml:"topMovesPerPlayer"`
+		// WinrateProperties selects the per-node winrate properties that are
+		// written for winrate graphs in SGF viewers: "sbkv" for Sabaki, "lz"
+		// for Lizzie, "all" or "none"
+		WinrateProperties string `yaml:"winrateProperties"`
 	} `yaml:"sgf"`
 }
 
@@ -82,6 +192,7 @@ func main() {
 	var sgfOpts string
 	var katagoOpts string
 	var revisit int
+	var workers int
 	var saveJSON bool
 	var analyzeJSON bool
 	var help bool
@@ -90,6 +201,7 @@ func main() {
 	flag.StringVar(&sgfOpts, "g", "", "Options for making reviewed SGF files")
 	flag.StringVar(&katagoOpts, "k", "", "Options for path and arguments of KataGo")
 	flag.IntVar(&revisit, "r", 0, "For variation cases, Analyze again with maxVisits N")
+	flag.IntVar(&workers, "j", 1, "Number of files to analyze in parallel")
 	flag.BoolVar(&saveJSON, "s", false, "Save KataGo analysis as JSON files")
 	flag.BoolVar(&analyzeJSON, "f", false, "Analyze by KataGo JSON files")
 	flag.BoolVar(&help, "h", false, "Display this help and exit")
@@ -102,7 +214,7 @@ func main() {
 	}
 
 	if len(flag.Args()) == 0 {
-		fmt.Println("Please specify SGF/GIB files.")
+		fmt.Println("Please specify SGF/GIB files or directories.")
 		displayHelp()
 		return
 	}
@@ -126,6 +238,7 @@ func main() {
 	// Override options if provided through command-line
 	if analysisOpts != "" {
 		analysisOverrides := parseOptions(analysisOpts)
+		opts.Analysis.Overrides = analysisOverrides
 		for k, v := range analysisOverrides {
 			switch k {
 			case "rules":
@@ -138,6 +251,22 @@ func main() {
 				opts.Analysis.BoardYSize = parseInt(v)
 			case "maxVisits":
 				opts.Analysis.MaxVisits = parseInt(v)
+			case "analyzeTurns":
+				parseYAMLOption(k, v, &opts.Analysis.AnalyzeTurns)
+			case "rootPolicyTemperature":
+				opts.Analysis.RootPolicyTemperature = parseFloat(v)
+			case "includeOwnership":
+				opts.Analysis.IncludeOwnership = parseBool(v)
+			case "includePolicy":
+				opts.Analysis.IncludePolicy = parseBool(v)
+			case "includePVVisits":
+				opts.Analysis.IncludePVVisits = parseBool(v)
+			case "avoidMoves":
+				parseYAMLOption(k, v, &opts.Analysis.AvoidMoves)
+			case "allowMoves":
+				parseYAMLOption(k, v, &opts.Analysis.AllowMoves)
+			case "overrideSettings":
+				parseYAMLOption(k, v, &opts.Analysis.OverrideSettings)
 			}
 		}
 	}
@@ -162,10 +291,30 @@ func main() {
 				opts.SGF.MaxVariationsForEachMove = parseInt(v)
 			case "fileSuffix":
 				opts.SGF.FileSuffix = v
+			case "rankBy":
+				opts.SGF.RankBy = v
+			case "topMovesPerPlayer":
+				opts.SGF.TopMovesPerPlayer = parseInt(v)
+			case "winrateProperties":
+				opts.SGF.WinrateProperties = v
 			}
 		}
 	}
 
+	// Reviewed SGF files must never overwrite the game records
+	if opts.SGF.FileSuffix == "" {
+		opts.SGF.FileSuffix = "-analyzed"
+	}
+	if opts.SGF.TopMovesPerPlayer < 1 {
+		opts.SGF.TopMovesPerPlayer = 3
+	}
+	if !validRankBy(opts.SGF.RankBy) {
+		log.Fatalf("Invalid rankBy %q, expected winrate, points or blended", opts.SGF.RankBy)
+	}
+	if !validWinrateProperties(opts.SGF.WinrateProperties) {
+		log.Fatalf("Invalid winrateProperties %q, expected sbkv, lz, all or none", opts.SGF.WinrateProperties)
+	}
+
 	if katagoOpts != "" {
 		katagoOverrides := parseOptions(katagoOpts)
 		for k, v := range katagoOverrides {
@@ -178,24 +327,29 @@ func main() {
 				opts.KataGo.Model = v
 			case "config":
 				opts.KataGo.Config = v
+			case "engines":
+				opts.KataGo.Engines = parseInt(v)
 			}
 		}
 	}
 
-	// Process each file
-	for _, filePath := range filePaths {
-		processFile(filePath, opts, revisit, saveJSON, analyzeJSON)
+	// Process each file, directory or pattern
+	inputs := expandInputs(filePaths, opts, analyzeJSON)
+	summaries := runBatch(inputs, opts, workers, revisit, saveJSON, analyzeJSON)
+	if len(summaries) > 1 {
+		printSummary(summaries)
 	}
 }
 
 func displayHelp() {
-	fmt.Println(`Usage: analyze-sgf [-a=OPTS] [-g=OPTS] [-k=OPTS] [-s] [-f] FILE ...
+	fmt.Println(`Usage: analyze-sgf [-a=OPTS] [-g=OPTS] [-k=OPTS] [-j=N] [-s] [-f] FILE|DIR ...
 
 Option:
   -a, --analysis=OPTS     Options for KataGo Parallel Analysis Engine query
   -g, --sgf=OPTS          Options for making reviewed SGF files
   -k, --katago=OPTS       Options for path and arguments of KataGo
   -r, --revisit=N         For variation cases, Analyze again with maxVisits N
+  -j N                    Number of files to analyze in parallel
   -s                      Save KataGo analysis as JSON files
   -f                      Analyze by KataGo JSON files
   -h, --help              Display this help and exit
@@ -204,13 +358,19 @@ Examples:
   analyze-sgf baduk-1.sgf baduk-2.gib
   analyze-sgf 'https://www.cyberoro.com/gibo_new/giboviewer/......'
   analyze-sgf -a 'maxVisits:16400,analyzeTurns:[197,198]' baduk.sgf
+  analyze-sgf -a 'includeOwnership:true,overrideSettings:{wideRootNoise: 0.04}' baduk.sgf
   analyze-sgf -f baduk.json
+  analyze-sgf -j 4 -k 'engines:2' club-games/ 'games/2024-*.sgf'
+  analyze-sgf -g 'rankBy:points' baduk.sgf
   analyze-sgf -g 'maxVariationsForEachMove:15' -r 20000 baduk.sgf`)
 }
 
+// parseOptions parses options like "key1:value1,key2:value2". Commas inside
+// brackets or braces do not separate options, so that values can be YAML
+// lists or maps, like "avoidMoves:[{player: B, moves: [C3], untilDepth: 1}]".
 func parseOptions(opts string) map[string]string {
 	options := make(map[string]string)
-	for _, opt := range strings.Split(opts, ",") {
+	for _, opt := range splitOptions(opts) {
 		parts := strings.SplitN(opt, ":", 2)
 		if len(parts) == 2 {
 			options[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
@@ -219,6 +379,35 @@ func parseOptions(opts string) map[string]string {
 	return options
 }
 
+// splitOptions splits the options at commas that are not nested in brackets
+// or braces
+func splitOptions(opts string) []string {
+	parts := make([]string, 0)
+	depth := 0
+	start := 0
+	for i, r := range opts {
+		switch r {
+		case '[', '{':
+			depth++
+		case ']', '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, opts[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, opts[start:])
+}
+
+// parseYAMLOption parses an option value written as YAML
+func parseYAMLOption(key, value string, out interface{}) {
+	if err := yaml.Unmarshal([]byte(value), out); err != nil {
+		log.Fatalf("Error parsing option %s: %v", key, err)
+	}
+}
+
 func parseFloat(s string) float64 {
 	v, _ := strconv.ParseFloat(s, 64)
 	return v
@@ -234,236 +423,450 @@ func parseBool(s string) bool {
 	return v
 }
 
-func processFile(filePath string, opts Options, revisit int, saveJSON bool, analyzeJSON bool) {
-	node, err := LoadSGF(filePath)
-	if err != nil {
-		log.Fatalf("Error loading SGF file: %v", err)
+func processFile(filePath string, engine *KataGoClient, opts Options, revisit int, saveJSON bool, analyzeJSON bool) ([]GameSummary, error) {
+	// With -f, the game and the KataGo responses are loaded from a JSON file
+	if analyzeJSON {
+		node, analysis, err := loadAnalysisJSON(filePath)
+		if err != nil {
+			return nil, err
+		}
+		base := strings.TrimSuffix(filePath, filepath.Ext(filePath))
+		summary, err := processGame(node, base, nil, opts, revisit, saveJSON, analysis)
+		if err != nil {
+			log.Printf("Error analyzing %s: %v", summary.Name, err)
+			summary.Status = "failed: " + err.Error()
+		}
+		return []GameSummary{summary}, nil
 	}
 
-	initialStones, moves := extractMoves(node)
-
-	// Channel to send requests to the KataGo goroutine
-	requestCh := make(chan AnalysisRequest)
-	// Channel to receive responses from the KataGo goroutine
-	responseCh := make(chan AnalysisResponse)
-
-	var wg sync.WaitGroup
+	games, err := LoadGames(filePath)
+	if err != nil {
+		return nil, err
+	}
 
-	// Start the KataGo goroutine
-	wg.Add(1)
-	go kataGoAnalyzer(opts, requestCh, responseCh, &wg)
+	// Each game of a collection gets its own output files
+	summaries := make([]GameSummary, 0, len(games))
+	base := strings.TrimSuffix(filePath, filepath.Ext(filePath))
+	for i, node := range games {
+		gameBase := base
+		if len(games) > 1 {
+			gameBase = fmt.Sprintf("%s-%d", base, i+1)
+		}
+		summary, err := processGame(node, gameBase, engine, opts, revisit, saveJSON, nil)
+		if err != nil {
+			log.Printf("Error analyzing %s: %v", summary.Name, err)
+			summary.Status = "failed: " + err.Error()
+		}
+		summaries = append(summaries, summary)
+	}
 
-	moveEvaluations := make([]MoveInfo, 0)
+	return summaries, nil
+}
 
-	for i := range moves {
-		request := AnalysisRequest{
-			ID:            fmt.Sprintf("analysis_%d", i),
-			InitialStones: initialStones,
-			Moves:         moves[:i+1],
-			Rules:         opts.Analysis.Rules,
-			Komi:          opts.Analysis.Komi,
-			BoardXSize:    opts.Analysis.BoardXSize,
-			BoardYSize:    opts.Analysis.BoardYSize,
-			AnalyzeTurns:  []int{i},
+// processGame analyzes a single game with KataGo and reports the worst moves.
+// Output files are named after base. Positions that already have a response
+// are not analyzed again, and without an engine only those positions are
+// evaluated.
+func processGame(node *sgf.Node, base string, engine *KataGoClient, opts Options, revisit int, saveJSON bool, analysis *Analysis) (GameSummary, error) {
+	settings := gameSettings(node, opts)
+	if err := coord.CheckSize(settings.BoardXSize, settings.BoardYSize); err != nil {
+		return newGameSummary(node, base, 0, nil), err
+	}
+	addHandicapStones(node, settings)
+	template := requestTemplate(settings, kataGoRules(settings.Rules, opts.Analysis.Rules), opts)
+	initialStones, moves, _ := extractMoves(node, settings)
+	lines := extractLines(node, settings)
+	positions := extractPositions(lines)
+
+	// Responses are loaded from a JSON file when analyzing with -f
+	if analysis == nil {
+		analysis = newAnalysis()
+	}
+	if analysis.Perspective == "" {
+		analysis.Perspective = kataGoPerspective(opts)
+	}
+	analysis.resolveRaw(lines)
+
+	// Every line is analyzed with one query, which skips the positions that
+	// already have a response. With analyzeTurns given by -a, only those
+	// turns of each line are analyzed.
+	if engine != nil {
+		turns := make(map[int]bool, len(opts.Analysis.AnalyzeTurns))
+		for _, turn := range opts.Analysis.AnalyzeTurns {
+			turns[turn] = true
 		}
+		err := analyzeLines(context.Background(), engine, template, lines, func(turn int, path string) bool {
+			_, ok := analysis.Responses[path]
+			return !ok && (len(turns) == 0 || turns[turn])
+		}, 0, analysis, reportProgress(base))
+		if err != nil {
+			return newGameSummary(node, base, len(moves), nil), err
+		}
+	}
 
-		// Send request to KataGo goroutine
-		requestCh <- request
-
-		// Wait for the response
-		response := <-responseCh
+	moveEvaluations := evaluateMoves(positions, analysis)
 
-		// Process the response
-		if len(response.MoveInfos) > 0 {
-			moveInfo := MoveInfo{
-				Player:  moves[i][0],
-				Move:    moves[i][1],
-				Winrate: response.MoveInfos[0].Winrate,
-				Drop:    0.5 - response.MoveInfos[0].Winrate, // Assuming initial winrate is 0.5
+	// Analyze the variation cases again with more visits, keeping the
+	// results of the first pass
+	if revisit > 0 && engine != nil {
+		byPath := make(map[string]Position, len(positions))
+		for _, pos := range positions {
+			byPath[pos.Path] = pos
+		}
+		// again holds the move number of the move that each position is
+		// analyzed again for
+		again := make(map[string]int)
+		for _, moveInfo := range moveEvaluations {
+			if moveInfo.Drop*100 < opts.SGF.MinWinRateDropForVariations {
+				continue
+			}
+			// Both positions of the move are analyzed again
+			pos := byPath[moveInfo.Path]
+			for _, path := range []string{pos.Before, pos.Path} {
+				if _, ok := analysis.FirstPass[path]; !ok {
+					analysis.FirstPass[path] = analysis.Responses[path]
+					again[path] = moveInfo.MoveNumber
+				}
 			}
-			moveEvaluations = append(moveEvaluations, moveInfo)
+		}
+		if len(again) > 0 {
+			// The deeper responses are collected separately, so that a
+			// position keeps its first pass if KataGo gives no results
+			deeper := newAnalysis()
+			deeper.Perspective = analysis.Perspective
+			err := analyzeLines(context.Background(), engine, template, lines, func(turn int, path string) bool {
+				_, ok := again[path]
+				return ok
+			}, revisit, deeper, nil)
+			if err != nil {
+				return newGameSummary(node, base, len(moves), nil), err
+			}
+			failed := make(map[int]string)
+			for path, moveNumber := range again {
+				if response, ok := deeper.Responses[path]; ok {
+					analysis.Responses[path] = response
+					continue
+				}
+				delete(analysis.FirstPass, path)
+				failed[moveNumber] = deeper.Skipped[path]
+				if failed[moveNumber] == "" {
+					failed[moveNumber] = "no response"
+				}
+			}
+			for path, warnings := range deeper.Warnings {
+				for _, w := range warnings {
+					analysis.addWarning(path, w)
+				}
+			}
+			numbers := make([]int, 0, len(failed))
+			for moveNumber := range failed {
+				numbers = append(numbers, moveNumber)
+			}
+			sort.Ints(numbers)
+			for _, moveNumber := range numbers {
+				log.Printf("%s: analyzing move %d again failed (%s), keeping the first pass", base, moveNumber, failed[moveNumber])
+			}
+			moveEvaluations = evaluateMoves(positions, analysis)
 		}
 	}
 
-	// Close the request channel to signal the KataGo goroutine to exit
-	close(requestCh)
-	// Wait for the KataGo goroutine to finish
-	wg.Wait()
+	classifyMoves(moveEvaluations, opts)
+	skipped := skippedMoves(positions, analysis)
+	warned := warnedMoves(lines, positions, analysis)
 
-	// Find the worst moves
-	worstMoves := findWorstMoves(moveEvaluations, 3)
-
-	// Output the worst moves
-	for i, move := range worstMoves {
-		fmt.Printf("Worst move %d: %s by %s with winrate drop %.2f\n", i+1, move.Move, move.Player, move.Drop)
-	}
-
-	// Save JSON if required
+	// Save JSON if required, before the evaluations are sorted
 	if saveJSON {
-		saveAnalysisAsJSON(filePath, initialStones, moves, moveEvaluations)
+		if err := saveAnalysisAsJSON(base+".json", node, initialStones, moves, moveEvaluations, analysis); err != nil {
+			return newGameSummary(node, base, len(moves), nil), err
+		}
 	}
-}
 
-func saveAnalysisAsJSON(filePath string, initialStones [][2]string, moves [][2]string, moveEvaluations []MoveInfo) {
-	jsonData := map[string]interface{}{
-		"initialStones": initialStones,
-		"moves":         moves,
-		"evaluations":   moveEvaluations,
+	review := Review{
+		Root:        node,
+		Lines:       lines,
+		Evaluations: moveEvaluations,
+		Skipped:     skipped,
+		Warned:      warned,
+		Analysis:    analysis,
+		Settings:    settings,
 	}
-
-	file, err := os.Create(strings.TrimSuffix(filePath, ".sgf") + ".json")
-	if err != nil {
-		log.Fatalf("Error creating JSON file: %v", err)
+	if err := saveReviewedSGF(reviewedSGFPath(base, opts), review, opts); err != nil {
+		return newGameSummary(node, base, len(moves), nil), err
 	}
-	defer file.Close()
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(jsonData); err != nil {
-		log.Fatalf("Error writing JSON file: %v", err)
+	// Find the worst and best moves of each player
+	ranked := rankMoves(moveEvaluations, opts.SGF.TopMovesPerPlayer, opts.SGF.RankBy)
+	if err := saveHTMLReport(htmlReportPath(base, opts), review, ranked); err != nil {
+		return newGameSummary(node, base, len(moves), nil), err
 	}
 
-	fmt.Printf("generated: %s\n", file.Name())
-}
-
-// kataGoAnalyzer runs KataGo and handles requests for analysis
-func kataGoAnalyzer(opts Options, requestCh <-chan AnalysisRequest, responseCh chan<- AnalysisResponse, wg *sync.WaitGroup) {
-	defer wg.Done()
-
-	// Start KataGo in analysis mode
-	args := strings.Fields(opts.KataGo.Arguments)
-	cmd := exec.Command(opts.KataGo.Path, args...)
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		log.Fatalf("Failed to get stdin: %v", err)
+	// Output the moves, at once since other games may be analyzed in
+	// parallel
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s:\n", base)
+	counts := countClasses(moveEvaluations)
+	for _, player := range players {
+		c := counts[player]
+		fmt.Fprintf(&sb, "%s: %d good, %d neutral, %d bad, %d hotspot\n", player, c[classGood], c[classNeutral], c[classBad], c[classHotSpot])
 	}
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatalf("Failed to get stdout: %v", err)
+	for _, player := range players {
+		for i, move := range ranked[player].Worst {
+			fmt.Fprintf(&sb, "Worst move %d by %s: %s\n", i+1, player, describeMove(move))
+		}
 	}
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		log.Fatalf("Failed to get stderr: %v", err)
+	for _, player := range players {
+		for i, move := range ranked[player].Best {
+			fmt.Fprintf(&sb, "Best move %d by %s: %s\n", i+1, player, describeMove(move))
+		}
+	}
+	for _, move := range skipped {
+		if move.Variation == 0 {
+			fmt.Fprintf(&sb, "move %d skipped: %s\n", move.MoveNumber, move.Skipped)
+		} else {
+			fmt.Fprintf(&sb, "move %d (%s) skipped: %s\n", move.MoveNumber, variationName(move.Variation), move.Skipped)
+		}
 	}
-	if err := cmd.Start(); err != nil {
-		log.Fatalf("Failed to start KataGo: %v", err)
+	for _, move := range warned {
+		for _, warning := range move.Warnings {
+			switch {
+			case move.MoveNumber == 0:
+				fmt.Fprintf(&sb, "KataGo warning: %s\n", warning)
+			case move.Variation == 0:
+				fmt.Fprintf(&sb, "move %d KataGo warning: %s\n", move.MoveNumber, warning)
+			default:
+				fmt.Fprintf(&sb, "move %d (%s) KataGo warning: %s\n", move.MoveNumber, variationName(move.Variation), warning)
+			}
+		}
 	}
+	fmt.Print(sb.String())
 
-	// Read stderr to debug any issues
-	go func() {
-		scanner := bufio.NewScanner(stderr)
-		for scanner.Scan() {
-			fmt.Printf("KataGo stderr: %s\n", scanner.Text())
+	summary := newGameSummary(node, base, len(moves), findWorstMoves(mainLineMoves(moveEvaluations), 1, opts.SGF.RankBy))
+	if len(skipped) > 0 {
+		summary.Status = fmt.Sprintf("analyzed, %d skipped", len(skipped))
+	}
+	return summary, nil
+}
+
+// requestTemplate creates the parts of a KataGo query that are the same for
+// all positions of a game
+func requestTemplate(settings GameSettings, rules KataGoRules, opts Options) AnalysisRequest {
+	return AnalysisRequest{
+		Rules:                 rules,
+		Komi:                  settings.Komi,
+		BoardXSize:            settings.BoardXSize,
+		BoardYSize:            settings.BoardYSize,
+		InitialPlayer:         settings.InitialPlayer,
+		MaxVisits:             opts.Analysis.MaxVisits,
+		RootPolicyTemperature: opts.Analysis.RootPolicyTemperature,
+		IncludeOwnership:      opts.Analysis.IncludeOwnership,
+		IncludePolicy:         opts.Analysis.IncludePolicy,
+		IncludePVVisits:       opts.Analysis.IncludePVVisits,
+		AvoidMoves:            opts.Analysis.AvoidMoves,
+		AllowMoves:            opts.Analysis.AllowMoves,
+		OverrideSettings:      jsonCompatible(opts.Analysis.OverrideSettings),
+	}
+}
+
+// maxTurnsPerQuery is the largest number of turns that are analyzed by a
+// single KataGo query. Longer lines are split into several queries, so that
+// progress is reported and engines shared with other games are not blocked
+// for too long.
+const maxTurnsPerQuery = 100
+
+// querySeq numbers the queries, since games that are analyzed at the same
+// time can have lines with the same path
+var querySeq atomic.Int64
+
+// analyzeLines analyzes the selected turns of every line, with one query per
+// line that lists all the turns in analyzeTurns. A position that is shared by
+// several lines is only analyzed once. The responses arrive in any order and
+// are stored by the path of their position. If maxVisits is not 0, it
+// overrides the visits of the template. progress is called after each
+// response with the number of analyzed and selected positions.
+func analyzeLines(ctx context.Context, engine *KataGoClient, template AnalysisRequest, lines []Line, selected func(turn int, path string) bool, maxVisits int, analysis *Analysis, progress func(done, total int)) error {
+	requests := make([]AnalysisRequest, 0)
+	lineOf := make(map[string]Line) // the line of each query
+	queued := make(map[string]bool)
+	for _, line := range lines {
+		turns := make([]int, 0)
+		for turn, path := range line.Paths {
+			if queued[path] || !selected(turn, path) {
+				continue
+			}
+			queued[path] = true
+			turns = append(turns, turn)
 		}
-		if err := scanner.Err(); err != nil {
-			fmt.Printf("Error reading stderr: %v\n", err)
+		for start := 0; start < len(turns); start += maxTurnsPerQuery {
+			chunk := turns[start:min(start+maxTurnsPerQuery, len(turns))]
+			request := template
+			request.ID = fmt.Sprintf("%s%s@%d#%d", queryIDPrefix, line.Leaf, chunk[0], querySeq.Add(1))
+			request.InitialStones = line.InitialStones
+			request.Moves = line.Moves[:chunk[len(chunk)-1]]
+			request.AnalyzeTurns = chunk
+			if maxVisits != 0 {
+				request.MaxVisits = maxVisits
+			}
+			requests = append(requests, request)
+			lineOf[request.ID] = line
 		}
-	}()
-
-	reader := bufio.NewReader(stdout)
-	writer := bufio.NewWriter(stdin)
+	}
 
-	for request := range requestCh {
-		// Send analysis request to KataGo
-		requestJSON, err := json.Marshal(request)
+	// All queries are sent at once, so that KataGo can work on them in
+	// parallel
+	type submitted struct {
+		query   *Query
+		request AnalysisRequest
+		line    Line
+	}
+	queries := make([]submitted, 0, len(requests))
+	for _, request := range requests {
+		query, err := engine.Submit(ctx, request)
 		if err != nil {
-			log.Fatalf("Failed to marshal request: %v", err)
+			return err
 		}
-		fmt.Fprintf(writer, "%s\n", requestJSON)
-		writer.Flush()
+		queries = append(queries, submitted{query, request, lineOf[request.ID]})
+	}
 
-		// Read response from KataGo
-		responseJSON, err := reader.ReadString('\n')
-		if err != nil {
-			log.Fatalf("Error reading response: %v", err)
+	done := 0
+	for i := 0; i < len(queries); i++ {
+		q := queries[i]
+		answered := make(map[int]bool)
+		for response := range q.query.Responses {
+			if response.TurnNumber < 0 || response.TurnNumber >= len(q.line.Paths) {
+				log.Printf("Ignoring KataGo response for turn %d of %s", response.TurnNumber, q.query.ID)
+				continue
+			}
+			answered[response.TurnNumber] = true
+			path := q.line.Paths[response.TurnNumber]
+			if err := response.Err(); err != nil {
+				analysis.Skipped[path] = err.Reason
+			} else {
+				analysis.Responses[path] = response
+			}
+			done++
+			if progress != nil {
+				progress(done, len(queued))
+			}
 		}
 
-		var response AnalysisResponse
-		if err := json.Unmarshal([]byte(responseJSON), &response); err != nil {
-			log.Fatalf("Failed to unmarshal response: %v", err)
+		// Warnings are about a whole query, so they are kept with its first
+		// analyzed move
+		if warnings := q.query.Warnings(); len(warnings) > 0 {
+			path := q.line.Paths[warningTurn(q.request.AnalyzeTurns)]
+			for _, w := range warnings {
+				analysis.addWarning(path, w.String())
+			}
 		}
 
-		// Send response to the main goroutine
-		responseCh <- response
-	}
+		err := q.query.Err()
+		if err == nil {
+			continue
+		}
+		var kataGoErr *KataGoError
+		if !errors.As(err, &kataGoErr) {
+			return fmt.Errorf("query %s: %v", q.query.ID, err)
+		}
 
-	// Close KataGo process
-	if err := cmd.Process.Kill(); err != nil {
-		log.Fatalf("Failed to kill KataGo process: %v", err)
+		// KataGo rejected the query. With an illegal move, the turns up to
+		// the move are analyzed again without the moves after it, and every
+		// position after it is skipped. Otherwise the turns that were not
+		// answered are skipped.
+		illegal, isIllegal := kataGoErr.IllegalMove()
+		if isIllegal && illegal+1 < len(q.line.Paths) {
+			analysis.Skipped[q.line.Paths[illegal+1]] = "illegal move"
+			for _, path := range q.line.Paths[illegal+2:] {
+				analysis.Skipped[path] = fmt.Sprintf("after illegal move %d", q.line.MoveNumbers[illegal])
+			}
+		} else {
+			log.Printf("Query %s: %v", q.query.ID, err)
+		}
+		retry := make([]int, 0)
+		for _, turn := range q.request.AnalyzeTurns {
+			switch {
+			case answered[turn]:
+			case isIllegal && turn <= illegal:
+				retry = append(retry, turn)
+			case !isIllegal:
+				analysis.Skipped[q.line.Paths[turn]] = kataGoErr.Message
+			}
+		}
+		if len(retry) > 0 {
+			request := q.request
+			request.ID = fmt.Sprintf("%s@%d#%d", strings.SplitN(request.ID, "@", 2)[0], retry[0], querySeq.Add(1))
+			request.Moves = request.Moves[:retry[len(retry)-1]]
+			request.AnalyzeTurns = retry
+			query, err := engine.Submit(ctx, request)
+			if err != nil {
+				return err
+			}
+			queries = append(queries, submitted{query, request, q.line})
+		}
 	}
+	return nil
 }
 
-// LoadSGF loads the SGF file and returns the root node
-func LoadSGF(filePath string) (*sgf.Node, error) {
-	node, err := sgf.Load(filePath)
-	if err != nil {
-		return nil, err
+// warningTurn returns the turn that the warnings of a query are kept with,
+// which is the first analyzed turn after a move, if there is one
+func warningTurn(turns []int) int {
+	for _, turn := range turns {
+		if turn > 0 {
+			return turn
+		}
+	}
+	if len(turns) == 0 {
+		return 0
 	}
-	return node, nil
+	return turns[0]
 }
 
-// extractMoves extracts initial stones and moves from the SGF file
-func extractMoves(node *sgf.Node) (initialStones [][2]string, moves [][2]string) {
-	initialStones = make([][2]string, 0)
-	moves = make([][2]string, 0)
-
-	for _, key := range []string{"AB", "AW"} {
-		for _, value := range node.AllValues(key) {
-			player := "black"
-			if key == "AW" {
-				player = "white"
-			}
-			initialStones = append(initialStones, [2]string{player, convertToGTP(value)})
+// reportProgress returns a progress function for analyzeLines that prints a
+// line for every tenth of the positions of a game
+func reportProgress(base string) func(done, total int) {
+	reported := 0
+	return func(done, total int) {
+		if step := done * 10 / total; step > reported {
+			reported = step
+			fmt.Printf("%s: analyzed %d of %d positions\n", base, done, total)
 		}
 	}
+}
 
-	for _, child := range node.Children() {
-		for _, key := range []string{"B", "W"} {
-			if move, ok := child.GetValue(key); ok {
-				player := "black"
-				if key == "W" {
-					player = "white"
-				}
-				moves = append(moves, [2]string{player, convertToGTP(move)})
+// jsonCompatible converts the maps that the YAML decoder creates for nested
+// values, which are keyed by interface{}, to maps keyed by strings, so that
+// they can be encoded as JSON. The settings are copied and not changed, since
+// the same options are shared by all games that are analyzed in parallel.
+func jsonCompatible(settings map[string]interface{}) map[string]interface{} {
+	if settings == nil {
+		return nil
+	}
+	var convert func(v interface{}) interface{}
+	convert = func(v interface{}) interface{} {
+		switch v := v.(type) {
+		case map[interface{}]interface{}:
+			m := make(map[string]interface{}, len(v))
+			for key, value := range v {
+				m[fmt.Sprint(key)] = convert(value)
 			}
+			return m
+		case []interface{}:
+			list := make([]interface{}, len(v))
+			for i, value := range v {
+				list[i] = convert(value)
+			}
+			return list
 		}
+		return v
 	}
-
-	return initialStones, moves
-}
-
-// convertToGTP converts an SGF coordinate to a GTP coordinate
-func convertToGTP(sgfCoord string) string {
-	if sgfCoord == "" {
-		return "pass"
+	converted := make(map[string]interface{}, len(settings))
+	for key, value := range settings {
+		converted[key] = convert(value)
 	}
-
-	colChar := sgfCoord[0]
-	rowChar := sgfCoord[1]
-
-	col := colChar - 'a'
-	row := 19 - (rowChar - 'a')
-
-	// Skip the 'I' column in GTP format
-	if col >= 8 {
-		col++
-	}
-
-	gtpCoord := fmt.Sprintf("%c%d", col+'A', row)
-	return gtpCoord
+	return converted
 }
 
-// findWorstMoves finds the worst moves based on winrate drop
-func findWorstMoves(moveEvaluations []MoveInfo, num int) []MoveInfo {
-	// Sort moves by winrate drop in descending order
-	sort.Slice(moveEvaluations, func(i, j int) bool {
-		return moveEvaluations[i].Drop > moveEvaluations[j].Drop
-	})
-
-	if len(moveEvaluations) > num {
-		return moveEvaluations[:num]
-	}
-	return moveEvaluations
+// startKataGo starts a KataGo analysis engine as configured
+func startKataGo(opts Options) (*KataGoClient, error) {
+	return NewKataGoClient(opts.KataGo.Path, strings.Fields(opts.KataGo.Arguments))
 }
 
 // loadConfig loads the configuration from a YAML file
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestJSONCompatible(t *testing.T) {
+	var settings map[string]interface{}
+	if err := yaml.Unmarshal([]byte("{a: [{b: 1}, 2], c: {d: [3]}}"), &settings); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(jsonCompatible(settings))
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	if want := `{"a":[{"b":1},2],"c":{"d":[3]}}`; string(data) != want {
+		t.Errorf("jsonCompatible = %s; want %s", data, want)
+	}
+
+	// The settings are shared by games that are analyzed in parallel, so
+	// they must not be changed
+	if first := settings["a"].([]interface{})[0]; first == nil {
+		t.Error("settings[a][0] is nil")
+	} else if _, ok := first.(map[interface{}]interface{}); !ok {
+		t.Errorf("settings[a][0] was changed to %T", first)
+	}
+
+	if jsonCompatible(nil) != nil {
+		t.Error("jsonCompatible(nil) is not nil")
+	}
+}
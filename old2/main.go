@@ -10,6 +10,7 @@ import (
 	"sync"
 
 	"github.com/rooklift/sgf"
+	"github.com/xyproto/top3/coord"
 )
 
 // MoveInfo represents information about a move
@@ -186,6 +187,7 @@ func LoadSGF(filePath string) (*sgf.Node, error) {
 func extractMoves(node *sgf.Node) (initialStones [][2]string, moves [][2]string) {
 	initialStones = make([][2]string, 0)
 	moves = make([][2]string, 0)
+	size := node.RootBoardSize()
 
 	for _, key := range []string{"AB", "AW"} {
 		for _, value := range node.AllValues(key) {
@@ -193,7 +195,7 @@ func extractMoves(node *sgf.Node) (initialStones [][2]string, moves [][2]string)
 			if key == "AW" {
 				player = "white"
 			}
-			initialStones = append(initialStones, [2]string{player, convertToGTP(value)})
+			initialStones = append(initialStones, [2]string{player, convertToGTP(value, size)})
 		}
 	}
 
@@ -204,7 +206,7 @@ func extractMoves(node *sgf.Node) (initialStones [][2]string, moves [][2]string)
 				if key == "W" {
 					player = "white"
 				}
-				moves = append(moves, [2]string{player, convertToGTP(move)})
+				moves = append(moves, [2]string{player, convertToGTP(move, size)})
 			}
 		}
 	}
@@ -213,23 +215,11 @@ func extractMoves(node *sgf.Node) (initialStones [][2]string, moves [][2]string)
 }
 
 // convertToGTP converts an SGF coordinate to a GTP coordinate
-func convertToGTP(sgfCoord string) string {
-	if sgfCoord == "" {
-		return "pass"
-	}
-
-	colChar := sgfCoord[0]
-	rowChar := sgfCoord[1]
-
-	col := colChar - 'a'
-	row := 19 - (rowChar - 'a')
-
-	// Skip the 'I' column in GTP format
-	if col >= 8 {
-		col++
+func convertToGTP(sgfCoord string, size int) string {
+	gtpCoord, err := coord.SGFToGTP(sgfCoord, size, size)
+	if err != nil {
+		log.Fatalf("Error converting %q: %v", sgfCoord, err)
 	}
-
-	gtpCoord := fmt.Sprintf("%c%d", col+'A', row)
 	return gtpCoord
 }
 
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/rooklift/sgf"
+)
+
+// GameSummary represents the outcome of analyzing a single game
+type GameSummary struct {
+	Name       string
+	Black      string
+	White      string
+	Date       string
+	Result     string
+	Moves      int
+	WorstMoves []MoveInfo
+	Status     string
+}
+
+// newGameSummary collects the game information from the root node together
+// with the worst moves that were found
+func newGameSummary(root *sgf.Node, name string, moves int, worstMoves []MoveInfo) GameSummary {
+	summary := GameSummary{
+		Name:       name,
+		Moves:      moves,
+		WorstMoves: worstMoves,
+		Status:     "analyzed",
+	}
+	summary.Black, _ = root.GetValue("PB")
+	summary.White, _ = root.GetValue("PW")
+	summary.Date, _ = root.GetValue("DT")
+	summary.Result, _ = root.GetValue("RE")
+	return summary
+}
+
+// printSummary prints a table with one line per game
+func printSummary(summaries []GameSummary) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "GAME\tBLACK\tWHITE\tDATE\tRESULT\tMOVES\tWORST MOVE\tSTATUS")
+	for _, s := range summaries {
+		worst := "-"
+		if len(s.WorstMoves) > 0 {
+			m := s.WorstMoves[0]
+			worst = fmt.Sprintf("move %d %s (%.2f%%, %.1f points)", m.MoveNumber, m.Move, m.Drop*100, m.ScoreDrop)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", s.Name, s.Black, s.White, s.Date, s.Result, s.Moves, worst, s.Status)
+	}
+	w.Flush()
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/rooklift/sgf"
+	"github.com/xyproto/top3/coord"
+)
+
+// reviewedSGFPath returns the path of the reviewed SGF file of a game, given
+// the base name of the game
+func reviewedSGFPath(base string, opts Options) string {
+	return base + opts.SGF.FileSuffix + ".sgf"
+}
+
+const (
+	// evenPosition is how far the winrate of Black may be from 50% for a
+	// position to be annotated as even
+	evenPosition = 0.1
+	// decidedPosition is how far the winrate of Black must be from 50% for a
+	// position to be annotated as very good for one player
+	decidedPosition = 0.4
+	// maxCandidateLabels is the number of KataGo candidates that are labeled
+	// on the board
+	maxCandidateLabels = 5
+)
+
+// Review holds everything that goes into the reviewed SGF file of a game
+type Review struct {
+	Root        *sgf.Node
+	Lines       []Line
+	Evaluations []MoveInfo
+	Skipped     []MoveInfo
+	Warned      []MoveInfo
+	Analysis    *Analysis
+	Settings    GameSettings
+}
+
+// saveReviewedSGF writes a copy of the game with the evaluation of every move
+// added to its comment, and the principal variations of KataGo's candidates
+// added as variations for the moves that lost enough. The original comments
+// and variations are kept.
+func saveReviewedSGF(filePath string, review Review, opts Options) error {
+	root, err := sgf.LoadSGF(review.Root.SGF())
+	if err != nil {
+		return err
+	}
+
+	// The copy has the same shape as the game, so nodes are found by path
+	nodes := make(map[string]*sgf.Node)
+	for _, node := range root.SubtreeNodes() {
+		nodes[nodePath(node)] = node
+	}
+
+	evaluations := make(map[string]MoveInfo, len(review.Evaluations))
+	for _, move := range review.Evaluations {
+		evaluations[move.Path] = move
+	}
+	counts := countClasses(review.Evaluations)
+	summary := make([]string, 0, len(players))
+	for _, player := range players {
+		c := counts[player]
+		summary = append(summary, fmt.Sprintf("%s: %d good, %d neutral, %d bad, %d hotspot", player, c[classGood], c[classNeutral], c[classBad], c[classHotSpot]))
+	}
+	addComment(root, "Analyzed by KataGo\n"+strings.Join(summary, "\n"))
+
+	for _, move := range review.Skipped {
+		if node := nodes[move.Path]; node != nil {
+			addComment(node, fmt.Sprintf("Skipped by KataGo: %s", move.Skipped))
+		}
+	}
+	for _, move := range review.Warned {
+		if node := nodes[move.Path]; node != nil {
+			for _, warning := range move.Warnings {
+				addComment(node, fmt.Sprintf("KataGo warning: %s", warning))
+			}
+		}
+	}
+
+	// New variations are added after the existing children, so the paths of
+	// the nodes of the game do not change
+	labeled := make(map[string]bool)
+	varied := make(map[string]bool)
+	for _, pos := range extractPositions(review.Lines) {
+		move, ok := evaluations[pos.Path]
+		node := nodes[pos.Path]
+		if !ok || node == nil {
+			continue
+		}
+		before := review.Analysis.Responses[pos.Before]
+		after := review.Analysis.Responses[pos.Path]
+		addComment(node, moveComment(move, before, after, review.Analysis.Perspective))
+		annotateMove(node, move, opts)
+		annotatePosition(node, move, after, review.Analysis.Perspective, opts)
+
+		// The candidates are marked on the position before the move, which
+		// is where a viewer shows them
+		if previous := nodes[pos.Before]; previous != nil {
+			if !labeled[pos.Before] {
+				labeled[pos.Before] = true
+				labelCandidates(previous, before, move.Player, review)
+			}
+			markPlayed(previous, move, review.Settings)
+		}
+
+		// The variations are added once for each position, even when more
+		// than one move of the game record from it is bad
+		if move.Drop*100 >= opts.SGF.MinWinRateDropForVariations && node.Parent() != nil && !varied[pos.Before] {
+			varied[pos.Before] = true
+			addVariations(node.Parent(), before, move.Player, review, opts)
+		}
+	}
+
+	if opts.SGF.ShowVariationsAfterLastMove {
+		for _, line := range review.Lines {
+			leaf := nodes[line.Leaf]
+			response, ok := review.Analysis.Responses[line.Paths[len(line.Paths)-1]]
+			if leaf == nil || !ok {
+				continue
+			}
+			toMove := review.Settings.InitialPlayer
+			if n := len(line.Moves); n > 0 {
+				toMove = opponent(line.Moves[n-1][0])
+			} else if toMove == "" {
+				toMove = "black"
+			}
+			addVariations(leaf, response, toMove, review, opts)
+		}
+	}
+
+	addWinrateProperties(nodes, review, opts.SGF.WinrateProperties)
+
+	if err := os.WriteFile(filePath, []byte(root.SGF()), 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("generated: %s\n", filePath)
+	return nil
+}
+
+// annotateMove adds the SGF move annotation for the class of a move: BM for
+// bad moves, with HO for hotspots, DO for neutral moves that lost nearly
+// enough to be bad, TE for KataGo's first choice in a critical position and
+// IT for moves that gained more than expected. A position is critical when
+// the second choice would have been a bad move.
+func annotateMove(node *sgf.Node, move MoveInfo, opts Options) {
+	switch move.Class {
+	case classHotSpot:
+		node.SetValue("BM", "2")
+		node.SetValue("HO", "1")
+	case classBad:
+		node.SetValue("BM", "1")
+	case classNeutral:
+		// Only the upper half of the neutral range is doubtful
+		doubtful := (opts.SGF.MaxWinRateDropForGoodMove + opts.SGF.MinWinRateDropForBadMove) / 2
+		if move.Drop*100 >= doubtful {
+			node.SetValue("DO", "")
+		}
+	case classGood:
+		if move.TopChoice && move.Margin*100 >= opts.SGF.MinWinRateDropForBadMove {
+			node.SetValue("TE", "1")
+		} else if -move.Drop*100 > opts.SGF.MaxWinRateDropForGoodMove {
+			node.SetValue("IT", "")
+		}
+	}
+}
+
+// annotatePosition adds the SGF position annotation for the winrate of
+// Black after the move: GB or GW when one player is ahead, and DM when the
+// position is even. UC marks positions where the first pass of -r and the
+// deeper analysis disagree about the move.
+func annotatePosition(node *sgf.Node, move MoveInfo, after AnalysisResponse, perspective string, opts Options) {
+	if move.Revisited && math.Abs(move.Drop-move.FirstPassDrop)*100 >= opts.SGF.MinWinRateDropForBadMove {
+		node.SetValue("UC", "1")
+		return
+	}
+	black, _ := playerValues(after, "black", opponent(move.Player), perspective)
+	lead := black - 0.5
+	switch {
+	case lead >= decidedPosition:
+		node.SetValue("GB", "2")
+	case lead > evenPosition:
+		node.SetValue("GB", "1")
+	case lead <= -decidedPosition:
+		node.SetValue("GW", "2")
+	case lead < -evenPosition:
+		node.SetValue("GW", "1")
+	default:
+		node.SetValue("DM", "1")
+	}
+}
+
+// labelCandidates labels the best candidates of KataGo with letters and
+// winrates, such as "A 54%", and marks the first choice with a triangle
+func labelCandidates(node *sgf.Node, response AnalysisResponse, toMove string, review Review) {
+	for i, candidate := range sortedCandidates(response) {
+		if i >= maxCandidateLabels {
+			break
+		}
+		point, err := coord.KataGoToSGF(candidate.Move, review.Settings.BoardXSize, review.Settings.BoardYSize)
+		if err != nil || point == "" {
+			continue
+		}
+		winrate, _ := candidateValues(response, candidate, toMove, review.Analysis.Perspective)
+		node.AddValue("LB", fmt.Sprintf("%s:%c %.0f%%", point, 'A'+i, winrate*100))
+		if i == 0 {
+			node.AddValue("TR", point)
+		}
+	}
+}
+
+// markPlayed marks the move that was played from a position with a square
+// if it was bad
+func markPlayed(node *sgf.Node, move MoveInfo, settings GameSettings) {
+	if move.Class != classBad && move.Class != classHotSpot {
+		return
+	}
+	point, err := coord.GTPToSGF(move.Move, settings.BoardXSize, settings.BoardYSize)
+	if err != nil || point == "" {
+		return
+	}
+	node.AddValue("SQ", point)
+}
+
+// Per-node winrate properties for the winrateProperties option
+const (
+	winratePropertiesSBKV = "sbkv"
+	winratePropertiesLZ   = "lz"
+	winratePropertiesAll  = "all"
+	winratePropertiesNone = "none"
+)
+
+// validWinrateProperties returns true if the winrateProperties option is
+// known. Empty means none.
+func validWinrateProperties(properties string) bool {
+	switch properties {
+	case "", winratePropertiesSBKV, winratePropertiesLZ, winratePropertiesAll, winratePropertiesNone:
+		return true
+	}
+	return false
+}
+
+// addWinrateProperties adds the evaluation of every analyzed position to its
+// node, so that SGF viewers can draw a winrate graph without an engine.
+// SBKV, as read by Sabaki, is the winrate of Black in percent. LZ, as read
+// by Lizzie, holds the winrate of the player who just moved in percent and
+// the visits, followed by the candidates with winrates for the player to
+// move in hundredths of a percent.
+func addWinrateProperties(nodes map[string]*sgf.Node, review Review, properties string) {
+	sbkv := properties == winratePropertiesSBKV || properties == winratePropertiesAll
+	lz := properties == winratePropertiesLZ || properties == winratePropertiesAll
+	if !sbkv && !lz {
+		return
+	}
+
+	done := make(map[string]bool)
+	for _, line := range review.Lines {
+		for turn, path := range line.Paths {
+			node := nodes[path]
+			response, ok := review.Analysis.Responses[path]
+			if done[path] || node == nil || !ok {
+				continue
+			}
+			done[path] = true
+
+			toMove := review.Settings.InitialPlayer
+			if turn > 0 {
+				toMove = opponent(line.Moves[turn-1][0])
+			} else if toMove == "" {
+				toMove = "black"
+			}
+			if sbkv {
+				black, _ := playerValues(response, "black", toMove, review.Analysis.Perspective)
+				node.SetValue("SBKV", fmt.Sprintf("%.2f", black*100))
+			}
+			if lz {
+				node.SetValue("LZ", lzValue(response, toMove, review.Analysis.Perspective))
+			}
+		}
+	}
+}
+
+// lzValue formats the evaluation of a position as the value of a Lizzie LZ
+// property
+func lzValue(response AnalysisResponse, toMove, perspective string) string {
+	winrate, _ := playerValues(response, opponent(toMove), toMove, perspective)
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "KataGo %.1f %d\n", winrate*100, response.RootInfo.Visits)
+	for i, candidate := range sortedCandidates(response) {
+		if i > 0 {
+			sb.WriteString(" ")
+		}
+		candidateWinrate, scoreLead := candidateValues(response, candidate, toMove, perspective)
+		fmt.Fprintf(&sb, "info move %s visits %d winrate %d scoreMean %.2f prior %d lcb %d order %d pv %s",
+			candidate.Move, candidate.Visits, int(math.Round(candidateWinrate*10000)), scoreLead,
+			int(math.Round(candidate.Prior*10000)), int(math.Round(lcbForPlayer(response, candidate, toMove, perspective)*10000)),
+			candidate.Order, strings.Join(candidate.PV, " "))
+	}
+	return sb.String()
+}
+
+// lcbForPlayer returns the lower confidence bound of the winrate of a
+// candidate, seen from the player to move
+func lcbForPlayer(response AnalysisResponse, candidate MoveInfoExt, toMove, perspective string) float64 {
+	lcb, _ := forPlayer(candidate.LCB, 0, reportedSide(response, toMove, perspective), toMove)
+	return lcb
+}
+
+// moveComment describes the evaluation of a move for its SGF comment
+func moveComment(move MoveInfo, before, after AnalysisResponse, perspective string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "KataGo: %s move\n", move.Class)
+	fmt.Fprintf(&sb, "Winrate: %.2f%% (drop %.2f%%)\n", move.Winrate*100, move.Drop*100)
+	fmt.Fprintf(&sb, "Score lead: %.1f (%.1f points lost)\n", move.ScoreLead, move.ScoreDrop)
+	if move.Revisited {
+		fmt.Fprintf(&sb, "First pass: drop %.2f%% and %.1f points\n", move.FirstPassDrop*100, move.FirstPassScoreDrop)
+	}
+	fmt.Fprintf(&sb, "Visits: %d", after.RootInfo.Visits)
+	if candidates := sortedCandidates(before); len(candidates) > 0 {
+		best := candidates[0]
+		winrate, _ := candidateValues(before, best, move.Player, perspective)
+		fmt.Fprintf(&sb, "\nKataGo's choice: %s (%.2f%%)", best.Move, winrate*100)
+	}
+	return sb.String()
+}
+
+// addVariations adds the principal variations of the candidates of a
+// response as children of the node. Candidates that are already played from
+// the node in the game record are left out, and so are bad candidates unless
+// showBadVariations is set.
+func addVariations(parent *sgf.Node, response AnalysisResponse, toMove string, review Review, opts Options) {
+	candidates := sortedCandidates(response)
+	if len(candidates) == 0 {
+		return
+	}
+	bestWinrate, _ := candidateValues(response, candidates[0], toMove, review.Analysis.Perspective)
+
+	added := 0
+	for _, candidate := range candidates {
+		if added >= opts.SGF.MaxVariationsForEachMove {
+			break
+		}
+		if len(candidate.PV) == 0 {
+			continue
+		}
+		winrate, scoreLead := candidateValues(response, candidate, toMove, review.Analysis.Perspective)
+		drop := bestWinrate - winrate
+		if !opts.SGF.ShowBadVariations && drop*100 >= opts.SGF.MinWinRateDropForBadMove {
+			continue
+		}
+		if addVariation(parent, candidate.PV, toMove, review.Settings) {
+			added++
+			variation := parent.Children()[len(parent.Children())-1]
+			addComment(variation, fmt.Sprintf("KataGo candidate: winrate %.2f%% (drop %.2f%%), score lead %.1f, visits %d", winrate*100, drop*100, scoreLead, candidate.Visits))
+		}
+	}
+}
+
+// addVariation adds a principal variation as a new child line of the node,
+// with the players taking turns starting with toMove. It returns false if
+// the variation has moves that cannot be written, or if a child of the node
+// already has its first move, which is then either a move of the game record
+// or a variation that was added before.
+func addVariation(parent *sgf.Node, pv []string, toMove string, settings GameSettings) bool {
+	if len(pv) == 0 {
+		return false
+	}
+	points := make([]string, 0, len(pv))
+	for _, move := range pv {
+		point, err := coord.KataGoToSGF(move, settings.BoardXSize, settings.BoardYSize)
+		if err != nil {
+			return false
+		}
+		points = append(points, point)
+	}
+	for _, child := range parent.Children() {
+		for _, key := range []string{"B", "W"} {
+			if value, ok := child.GetValue(key); ok && value == points[0] {
+				return false
+			}
+		}
+	}
+	node := parent
+	player := toMove
+	for _, point := range points {
+		node = sgf.NewNode(node)
+		key := "B"
+		if player == "white" {
+			key = "W"
+		}
+		node.SetValue(key, point)
+		player = opponent(player)
+	}
+	return true
+}
+
+// sortedCandidates returns the candidates of a response, best first
+func sortedCandidates(response AnalysisResponse) []MoveInfoExt {
+	candidates := make([]MoveInfoExt, len(response.MoveInfos))
+	copy(candidates, response.MoveInfos)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Order < candidates[j].Order
+	})
+	return candidates
+}
+
+// candidateValues returns the winrate and score lead of a candidate, seen
+// from the given player, who is the player to move in the position
+func candidateValues(response AnalysisResponse, candidate MoveInfoExt, player, perspective string) (float64, float64) {
+	side := reportedSide(response, player, perspective)
+	return forPlayer(candidate.Winrate, candidate.ScoreLead, side, player)
+}
+
+// addComment appends text to the comment of a node, keeping the comment that
+// is already there
+func addComment(node *sgf.Node, text string) {
+	if comment, ok := node.GetValue("C"); ok && strings.TrimSpace(comment) != "" {
+		text = comment + "\n\n" + text
+	}
+	node.SetValue("C", text)
+}
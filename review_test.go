@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rooklift/sgf"
+)
+
+func TestSaveReviewedSGFVariations(t *testing.T) {
+	root, err := sgf.LoadSGF(testTree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := GameSettings{BoardXSize: 9, BoardYSize: 9}
+
+	// Both moves 3 of the game record lose a lot. KataGo prefers D5, and its
+	// other choices are the moves of the game record.
+	analysis := newAnalysis()
+	analysis.Perspective = sideToMove
+	analysis.Responses["2"] = AnalysisResponse{MoveInfos: []MoveInfoExt{
+		{Move: "D5", Order: 0, Winrate: 0.60, PV: []string{"D5", "E6"}},
+		{Move: "G3", Order: 1, Winrate: 0.55, PV: []string{"G3", "C3"}},
+		{Move: "C3", Order: 2, Winrate: 0.50, PV: []string{"C3", "D4", "E4"}},
+	}}
+	review := Review{
+		Root:  root,
+		Lines: extractLines(root, settings),
+		Evaluations: []MoveInfo{
+			{Path: "3", MoveNumber: 3, Player: "black", Move: "G3", Drop: 0.30, Class: classHotSpot},
+			{Path: "3.1/3", MoveNumber: 3, Variation: 1, Player: "black", Move: "C3", Drop: 0.40, Class: classHotSpot},
+		},
+		Analysis: analysis,
+		Settings: settings,
+	}
+	var opts Options
+	opts.SGF.MinWinRateDropForVariations = 5
+	opts.SGF.ShowBadVariations = true
+	opts.SGF.MaxVariationsForEachMove = 10
+
+	filePath := filepath.Join(t.TempDir(), "reviewed.sgf")
+	if err := saveReviewedSGF(filePath, review, opts); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reviewed, err := sgf.LoadSGF(string(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// KataGo's variation is added once, after the two moves of the game
+	// record, whose lines are not added again
+	parent := reviewed.MainChild().MainChild()
+	moves := make([]string, 0)
+	for _, child := range parent.Children() {
+		move, _ := child.GetValue("B")
+		moves = append(moves, move)
+	}
+	if want := []string{"gg", "cg", "de"}; !reflect.DeepEqual(moves, want) {
+		t.Errorf("moves after move 2 = %v; want %v", moves, want)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"unicode"
+)
+
+// KataGoRules represents the rules of a KataGo query. Rules are either a rule
+// set known to KataGo by name, such as "japanese", or a full rule object for
+// rule sets that KataGo has no name for.
+type KataGoRules struct {
+	Name               string `json:"-"`
+	Ko                 string `json:"ko,omitempty"`
+	Scoring            string `json:"scoring,omitempty"`
+	Tax                string `json:"tax,omitempty"`
+	Suicide            bool   `json:"suicide"`
+	HasButton          bool   `json:"hasButton"`
+	WhiteHandicapBonus string `json:"whiteHandicapBonus,omitempty"`
+}
+
+// kataGoRuleSets maps normalized rule names, as found in the RU property of
+// SGF files in the wild, to KataGo rules
+var kataGoRuleSets = map[string]KataGoRules{
+	"tromptaylor":  {Name: "tromp-taylor"},
+	"tt":           {Name: "tromp-taylor"},
+	"japanese":     {Name: "japanese"},
+	"japan":        {Name: "japanese"},
+	"jp":           {Name: "japanese"},
+	"nihonkiin":    {Name: "japanese"},
+	"chinese":      {Name: "chinese"},
+	"china":        {Name: "chinese"},
+	"cn":           {Name: "chinese"},
+	"chineseogs":   {Name: "chinese-ogs"},
+	"chinesekgs":   {Name: "chinese-kgs"},
+	"korean":       {Name: "korean"},
+	"korea":        {Name: "korean"},
+	"kr":           {Name: "korean"},
+	"aga":          {Name: "aga"},
+	"american":     {Name: "aga"},
+	"agabutton":    {Name: "aga-button"},
+	"bga":          {Name: "bga"},
+	"british":      {Name: "bga"},
+	"newzealand":   {Name: "new-zealand"},
+	"nz":           {Name: "new-zealand"},
+	"stonescoring": {Name: "stone-scoring"},
+	"ancientarea":  {Name: "stone-scoring"},
+	"tygem":        {Name: "korean"},
+	"cyberoro":     {Name: "korean"},
+	"fox":          {Name: "chinese"},
+	"foxwq":        {Name: "chinese"},
+	"yike":         {Name: "chinese"},
+	"ing":          ingRules,
+	"ings":         ingRules,
+	"goe":          ingRules,
+	"inggoe":       ingRules,
+	"ingsgoe":      ingRules,
+}
+
+// ingRules approximates the Ing rules, which use area scoring, allow suicide
+// and resolve repetitions with a superko rule. KataGo has no name for them.
+var ingRules = KataGoRules{
+	Ko:                 "SITUATIONAL",
+	Scoring:            "AREA",
+	Tax:                "NONE",
+	Suicide:            true,
+	WhiteHandicapBonus: "0",
+}
+
+// MarshalJSON writes named rules as a string and other rules as an object
+func (r KataGoRules) MarshalJSON() ([]byte, error) {
+	if r.Name != "" {
+		return json.Marshal(r.Name)
+	}
+	type ruleObject KataGoRules
+	return json.Marshal(ruleObject(r))
+}
+
+// UnmarshalJSON reads rules written as either a string or an object
+func (r *KataGoRules) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*r = KataGoRules{Name: name}
+		return nil
+	}
+	type ruleObject KataGoRules
+	var obj ruleObject
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+	*r = KataGoRules(obj)
+	return nil
+}
+
+// String returns the name of the rules, or a short description of a rule
+// object
+func (r KataGoRules) String() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return strings.ToLower("ko" + r.Ko + " scoring" + r.Scoring + " tax" + r.Tax)
+}
+
+// normalizeRuleName lowercases a rule name and strips everything but letters
+// and digits, as well as a trailing "rules"
+func normalizeRuleName(name string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			sb.WriteRune(r)
+		}
+	}
+	normalized := sb.String()
+	if trimmed := strings.TrimSuffix(normalized, "rules"); trimmed != "" {
+		normalized = trimmed
+	}
+	return normalized
+}
+
+// lookupRules returns the KataGo rules for a rule name, if it is known
+func lookupRules(name string) (KataGoRules, bool) {
+	rules, ok := kataGoRuleSets[normalizeRuleName(name)]
+	return rules, ok
+}
+
+// kataGoRules translates the rules of a game to KataGo rules. Unknown rule
+// names fall back to the configured default rules, with a warning.
+func kataGoRules(name, defaultName string) KataGoRules {
+	if rules, ok := lookupRules(name); ok {
+		return rules
+	}
+	fallback, ok := lookupRules(defaultName)
+	if !ok {
+		// Let KataGo decide if it knows the configured rules
+		fallback = KataGoRules{Name: defaultName}
+	}
+	if name != defaultName {
+		log.Printf("Warning: unknown rules %q, using %q instead", name, fallback)
+	}
+	return fallback
+}
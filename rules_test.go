@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestKataGoRules(t *testing.T) {
+	tests := []struct {
+		name, defaultName string
+		want              string
+	}{
+		{"Japanese", "tromp-taylor", `"japanese"`},
+		{"japanese rules", "tromp-taylor", `"japanese"`},
+		{"Nihon-Kiin", "tromp-taylor", `"japanese"`},
+		{"jp", "tromp-taylor", `"japanese"`},
+		{"Chinese", "tromp-taylor", `"chinese"`},
+		{"CN", "tromp-taylor", `"chinese"`},
+		{"Fox", "tromp-taylor", `"chinese"`},
+		{"chinese_ogs", "tromp-taylor", `"chinese-ogs"`},
+		{"Chinese KGS", "tromp-taylor", `"chinese-kgs"`},
+		{"Korean", "tromp-taylor", `"korean"`},
+		{"Tygem", "tromp-taylor", `"korean"`},
+		{"AGA", "tromp-taylor", `"aga"`},
+		{"aga-button", "tromp-taylor", `"aga-button"`},
+		{"BGA", "tromp-taylor", `"bga"`},
+		{"New Zealand", "tromp-taylor", `"new-zealand"`},
+		{"NZ", "tromp-taylor", `"new-zealand"`},
+		{"Tromp-Taylor", "japanese", `"tromp-taylor"`},
+		{"TT", "japanese", `"tromp-taylor"`},
+		{"stone scoring", "tromp-taylor", `"stone-scoring"`},
+		{"Ing", "tromp-taylor", `{"ko":"SITUATIONAL","scoring":"AREA","tax":"NONE","suicide":true,"hasButton":false,"whiteHandicapBonus":"0"}`},
+		{"GOE", "tromp-taylor", `{"ko":"SITUATIONAL","scoring":"AREA","tax":"NONE","suicide":true,"hasButton":false,"whiteHandicapBonus":"0"}`},
+
+		// Unknown and missing rules fall back to the default rules, which may
+		// be unknown too
+		{"", "japanese", `"japanese"`},
+		{"house rules", "Chinese", `"chinese"`},
+		{"house rules", "my-rules", `"my-rules"`},
+	}
+	for _, tt := range tests {
+		data, err := json.Marshal(kataGoRules(tt.name, tt.defaultName))
+		if err != nil {
+			t.Errorf("kataGoRules(%q, %q): %v", tt.name, tt.defaultName, err)
+			continue
+		}
+		if string(data) != tt.want {
+			t.Errorf("kataGoRules(%q, %q) = %s; want %s", tt.name, tt.defaultName, data, tt.want)
+		}
+	}
+}
+
+func TestKataGoRulesJSON(t *testing.T) {
+	for _, rules := range []KataGoRules{{Name: "japanese"}, ingRules} {
+		data, err := json.Marshal(rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded KataGoRules
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("decoding %s: %v", data, err)
+		}
+		if decoded != rules {
+			t.Errorf("decoding %s = %+v; want %+v", data, decoded, rules)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// svgboard draws the position after move N of an SGF file as an SVG image,
+// following the main line of the game
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rooklift/sgf"
+	"github.com/xyproto/top3/coord"
+	"github.com/xyproto/top3/diagram"
+)
+
+func main() {
+	var (
+		outFile     string
+		crop        string
+		coordinates bool
+	)
+	flag.StringVar(&outFile, "o", "", "Write the SVG image to this file instead of stdout")
+	flag.StringVar(&crop, "crop", "", "Only draw a region of the board, given by two corners, e.g. A19:K10")
+	flag.BoolVar(&coordinates, "coords", true, "Draw coordinates around the board")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: svgboard [options] file.sgf [move number]\n\nOptions:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 || flag.NArg() > 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	moveNumber := 0
+	if flag.NArg() == 2 {
+		n, err := strconv.Atoi(flag.Arg(1))
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid move number: %s", flag.Arg(1))
+		}
+		moveNumber = n
+	}
+
+	root, err := sgf.Load(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("Error loading SGF file: %v", err)
+	}
+	if size, _ := root.GetValue("SZ"); strings.Contains(size, ":") {
+		log.Fatalf("Rectangular boards are not supported: %s", size)
+	}
+
+	node, last, found := nodeAtMove(root, moveNumber)
+	if !found {
+		log.Fatalf("The game has no move %d", moveNumber)
+	}
+
+	board := diagram.FromSGF(node.Board())
+	board.Coordinates = coordinates
+	if last != "" {
+		if x, y, err := coord.SGFToXY(last, board.Width, board.Height); err == nil {
+			board.LastMove = &diagram.Point{X: x, Y: y}
+		}
+	}
+	if crop != "" {
+		region, err := parseRegion(crop, board.Width, board.Height)
+		if err != nil {
+			log.Fatalf("Invalid region %q: %v", crop, err)
+		}
+		board.Crop = &region
+	}
+
+	svg := board.SVG() + "\n"
+	if outFile == "" {
+		fmt.Print(svg)
+		return
+	}
+	if err := os.WriteFile(outFile, []byte(svg), 0o644); err != nil {
+		log.Fatalf("Error writing %s: %v", outFile, err)
+	}
+}
+
+// nodeAtMove follows the main line to the node of the given move number, and
+// returns it together with the SGF point of the move. Move 0 is the root.
+func nodeAtMove(root *sgf.Node, moveNumber int) (*sgf.Node, string, bool) {
+	node, last := root, ""
+	for moveCount := 0; moveCount < moveNumber; {
+		children := node.Children()
+		if len(children) == 0 {
+			return nil, "", false
+		}
+		node = children[0]
+		for _, key := range []string{"B", "W"} {
+			if p, ok := node.GetValue(key); ok {
+				moveCount++
+				last = p
+				break
+			}
+		}
+	}
+	return node, last, true
+}
+
+// parseRegion parses two corners in GTP coordinates, such as "A19:K10"
+func parseRegion(s string, width, height int) (diagram.Region, error) {
+	corners := strings.Split(s, ":")
+	if len(corners) != 2 {
+		return diagram.Region{}, fmt.Errorf("expected two corners separated by a colon")
+	}
+	var points [2]diagram.Point
+	for i, corner := range corners {
+		x, y, err := coord.GTPToXY(corner, width, height)
+		if err != nil {
+			return diagram.Region{}, err
+		}
+		points[i] = diagram.Point{X: x, Y: y}
+	}
+	return diagram.Region{Min: points[0], Max: points[1]}, nil
+}